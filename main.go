@@ -1,20 +1,124 @@
 package auctions_db
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Interval identifies the snapshot period an auctions row aggregates over. It
+// is matched against auctions.interval as-is; no durations are derived from
+// it, so callers that need a step in seconds pass it explicitly.
+type Interval int16
+
+const (
+	IntervalHourly Interval = 1
+	IntervalDaily  Interval = 24
+)
+
+// Valid reports whether interval is one of the known constants.
+func (interval Interval) Valid() bool {
+	switch interval {
+	case IntervalHourly, IntervalDaily:
+		return true
+	}
+	return false
+}
+
+type FillStrategy int
+
+const (
+	// FillNull leaves snapshots without listings as nil values.
+	FillNull FillStrategy = iota
+	// FillPrevious carries the last known values forward into snapshots
+	// without listings. Points before the first known value stay nil.
+	FillPrevious
 )
 
 type Database struct {
 	BatchSize int
-	db        *pg.DB
+	// OnBulkInsert, when set, is called after InsertAuctions or a Replace*
+	// method completes successfully.
+	OnBulkInsert func(BulkStats)
+	// OnReplace, when set, is called as a Replace* method swaps its table in,
+	// giving an audit trail of each swap.
+	OnReplace func(ReplaceEvent)
+	// AllowEmptyReplace lets the Replace* methods swap in an empty table.
+	// It is off by default so an upstream outage that yields no rows can't
+	// wipe the live data.
+	AllowEmptyReplace bool
+	// ServerTimestamps makes InsertAuctions fill a zero Timestamp with the
+	// database server's current epoch, writing it back to the Auction. Rows
+	// with an explicit timestamp keep it, so both can be mixed in one call.
+	ServerTimestamps bool
+	// ZeroPricesAsNull makes GetAuctionsAsTimeSeries and ComputePriceAverages
+	// treat a stored price of 0 as missing. The price columns (min, max and
+	// p05 through p90) are tagged use_zero, so a snapshot without a buyout
+	// price is stored as 0 rather than NULL; no item really sells for 0
+	// copper, so with this set those columns read as NULL (nil in
+	// AuctionSeriesPoint) and are skipped by averages instead of pulling
+	// them down. quantity is never affected, as a zero quantity is genuine.
+	ZeroPricesAsNull bool
+	// DefaultDirection is the sort direction, "asc" or "desc", used by the
+	// current auction listings when a call passes an empty direction.
+	DefaultDirection string
+	// CopyCurrentAuctions makes ReplaceCurrentAuctions and ReplaceAll load
+	// current_auctions_temp with a single COPY instead of BatchSize INSERTs.
+	// BenchmarkReplaceCurrentAuctions compares the two loaders.
+	CopyCurrentAuctions bool
+	// Debug enables developer-only helpers such as ExplainAnalyze.
+	Debug               bool
+	statementTimeout    time.Duration
+	currentAuctionStmts *stmtPool
+	db                  *pg.DB
+	tx                  *pg.Tx
+}
+
+type BulkStats struct {
+	Table        string
+	RowsInserted int
+	BatchCount   int
+	Duration     time.Duration
+}
+
+var ErrEmptyReplace = errors.New("refusing to replace table with no rows")
+
+// ErrReplaceInProgress is returned by a Replace* method while another replace
+// of the same table is still running, from this or any other process.
+var ErrReplaceInProgress = errors.New("replace of table already in progress")
+
+var (
+	ErrRealmNotFound        = errors.New("realm not found")
+	ErrAuctionHouseNotFound = errors.New("auction house not found")
+)
+
+// ReplaceEvent describes one stage of a Replace* table swap. Stage is
+// "started", "committed" or "rolled_back"; for rollbacks Step names the
+// statement that failed and Err holds its error.
+type ReplaceEvent struct {
+	Table string
+	Stage string
+	Step  string
+	Time  time.Time
+	Err   error
 }
 
 type Realm struct {
 	tableName struct{} `pg:"realms"`
 	Id        int16    `pg:"id,pk"`
 	Name      string   `pg:"name"`
+	Enabled   bool     `pg:"enabled,use_zero"`
 }
 
 type AuctionHouse struct {
@@ -23,12 +127,18 @@ type AuctionHouse struct {
 	Name      string   `pg:"name"`
 }
 
+type AuctionHouseWithCount struct {
+	Id        int16  `pg:"id"`
+	Name      string `pg:"name"`
+	ItemCount int    `pg:"item_count"`
+}
+
 type Auction struct {
 	tableName      struct{} `pg:"auctions"`
 	RealmID        int16    `pg:"realm_id,pk"`
 	AuctionHouseID int16    `pg:"auction_house_id,pk"`
 	ItemID         int      `pg:"item_id,pk"`
-	Interval       int16    `pg:"interval,pk"`
+	Interval       Interval `pg:"interval,pk"`
 	Timestamp      int32    `pg:"timestamp,pk"`
 	Quantity       int32    `pg:"quantity"`
 	Min            int32    `pg:"min,use_zero"`
@@ -41,6 +151,95 @@ type Auction struct {
 	P90            int32    `pg:"p90,use_zero"`
 }
 
+// AuctionColumns holds an item's auction history as parallel arrays, one
+// element per snapshot, which is far more compact to serialize than a slice
+// of Auction.
+type AuctionColumns struct {
+	Timestamps []int32 `pg:"timestamps,array"`
+	Quantity   []int32 `pg:"quantity,array"`
+	Min        []int32 `pg:"min,array"`
+	Max        []int32 `pg:"max,array"`
+	P05        []int32 `pg:"p05,array"`
+	P10        []int32 `pg:"p10,array"`
+	P25        []int32 `pg:"p25,array"`
+	P50        []int32 `pg:"p50,array"`
+	P75        []int32 `pg:"p75,array"`
+	P90        []int32 `pg:"p90,array"`
+}
+
+type AuctionSeriesPoint struct {
+	Timestamp int32  `pg:"timestamp"`
+	Quantity  *int32 `pg:"quantity"`
+	Min       *int32 `pg:"min"`
+	Max       *int32 `pg:"max"`
+	P05       *int32 `pg:"p05"`
+	P10       *int32 `pg:"p10"`
+	P25       *int32 `pg:"p25"`
+	P50       *int32 `pg:"p50"`
+	P75       *int32 `pg:"p75"`
+	P90       *int32 `pg:"p90"`
+}
+
+// ItemVolatility summarizes an item's p50 over a window: its standard
+// deviation and the percent change from the first to the last snapshot.
+type ItemVolatility struct {
+	ItemID        int32   `pg:"item_id"`
+	ItemName      string  `pg:"item_name"`
+	ItemMediaURL  string  `pg:"item_media_url"`
+	ItemRarity    string  `pg:"item_rarity"`
+	Volatility    float64 `pg:"volatility"`
+	PercentChange float64 `pg:"percent_change"`
+}
+
+type TradedItemQueryResult struct {
+	ItemID        int32  `pg:"item_id"`
+	ItemName      string `pg:"item_name"`
+	ItemMediaURL  string `pg:"item_media_url"`
+	ItemRarity    string `pg:"item_rarity"`
+	TotalQuantity int64  `pg:"total_quantity"`
+}
+
+// AuctionDelta holds the change in each auctions field between two
+// snapshots, computed as the value at To minus the value at From.
+type AuctionDelta struct {
+	From     int32
+	To       int32
+	Quantity int32
+	Min      int32
+	Max      int32
+	P05      int32
+	P10      int32
+	P25      int32
+	P50      int32
+	P75      int32
+	P90      int32
+}
+
+type ItemListingCount struct {
+	ItemID       int32  `pg:"item_id"`
+	ItemName     string `pg:"item_name"`
+	ItemMediaURL string `pg:"item_media_url"`
+	ItemRarity   string `pg:"item_rarity"`
+	ListingCount int    `pg:"listing_count"`
+}
+
+type MovingAveragePoint struct {
+	Timestamp     int32   `pg:"timestamp"`
+	P50           int32   `pg:"p50,use_zero"`
+	MovingAverage float64 `pg:"moving_average"`
+}
+
+type MinPricePoint struct {
+	Timestamp int32 `pg:"timestamp"`
+	Min       int32 `pg:"min,use_zero"`
+}
+
+type WeightedPricePoint struct {
+	Timestamp   int32   `pg:"timestamp"`
+	Quantity    int32   `pg:"quantity"`
+	WeightedP50 float64 `pg:"weighted_p50"`
+}
+
 type CurrentAuction struct {
 	tableName      struct{} `pg:"current_auctions"`
 	RealmID        int16    `pg:"realm_id,pk"`
@@ -55,6 +254,7 @@ type CurrentAuction struct {
 	P50            int32    `pg:"p50,use_zero"`
 	P75            int32    `pg:"p75,use_zero"`
 	P90            int32    `pg:"p90,use_zero"`
+	MinBuyout      int32    `pg:"min_buyout"`
 }
 
 type currentAuctionsTemp struct {
@@ -71,6 +271,7 @@ type currentAuctionsTemp struct {
 	P50            int32    `pg:"p50,use_zero"`
 	P75            int32    `pg:"p75,use_zero"`
 	P90            int32    `pg:"p90,use_zero"`
+	MinBuyout      int32    `pg:"min_buyout"`
 }
 
 type CurrentAuctionQueryResult struct {
@@ -89,6 +290,172 @@ type CurrentAuctionQueryResult struct {
 	P50            int32  `pg:"p50,use_zero"`
 	P75            int32  `pg:"p75,use_zero"`
 	P90            int32  `pg:"p90,use_zero"`
+	MinBuyout      int32  `pg:"min_buyout"`
+}
+
+// CopperToGold converts a copper amount to gold rounded to two decimals, the
+// precision of a whole silver.
+func CopperToGold(copper int32) float64 {
+	return math.Round(float64(copper)/100) / 100
+}
+
+func (a CurrentAuctionQueryResult) MinGold() float64 { return CopperToGold(a.Min) }
+func (a CurrentAuctionQueryResult) MaxGold() float64 { return CopperToGold(a.Max) }
+func (a CurrentAuctionQueryResult) P05Gold() float64 { return CopperToGold(a.P05) }
+func (a CurrentAuctionQueryResult) P10Gold() float64 { return CopperToGold(a.P10) }
+func (a CurrentAuctionQueryResult) P25Gold() float64 { return CopperToGold(a.P25) }
+func (a CurrentAuctionQueryResult) P50Gold() float64 { return CopperToGold(a.P50) }
+func (a CurrentAuctionQueryResult) P75Gold() float64 { return CopperToGold(a.P75) }
+func (a CurrentAuctionQueryResult) P90Gold() float64 { return CopperToGold(a.P90) }
+
+// CurrentAuctionFilter narrows the rows returned by the current auction
+// listing methods. The zero value applies no filtering.
+type CurrentAuctionFilter struct {
+	// MinRarity keeps only items at or above this rarity, using the ordering
+	// poor < common < uncommon < rare < epic < legendary. Matching is
+	// case-insensitive.
+	MinRarity string
+	// Category keeps only items tagged with this category in item_categories.
+	Category string
+}
+
+var rarityRanks = map[string]int{
+	"poor":      0,
+	"common":    1,
+	"uncommon":  2,
+	"rare":      3,
+	"epic":      4,
+	"legendary": 5,
+}
+
+const rarityRankQuery = `CASE lower(items.rarity)
+	WHEN 'poor' THEN 0
+	WHEN 'common' THEN 1
+	WHEN 'uncommon' THEN 2
+	WHEN 'rare' THEN 3
+	WHEN 'epic' THEN 4
+	WHEN 'legendary' THEN 5
+	ELSE -1
+END`
+
+// Page is one page of a paginated listing. HasMore reports whether rows exist
+// beyond this page.
+type Page[T any] struct {
+	Items   []T
+	Offset  int32
+	Limit   int16
+	HasMore bool
+}
+
+// newPage builds a Page from rows fetched with a LIMIT of limit+1, trimming
+// the extra row that signals another page.
+func newPage[T any](items []T, offset int32, limit int16) *Page[T] {
+	page := &Page[T]{
+		Items:  items,
+		Offset: offset,
+		Limit:  limit,
+	}
+	if len(items) > int(limit) {
+		page.Items = items[:limit]
+		page.HasMore = true
+	}
+	return page
+}
+
+type CurrentAuctionPage struct {
+	Items []CurrentAuctionQueryResult
+	Total int
+}
+
+type currentAuctionPageRow struct {
+	CurrentAuctionQueryResult
+	TotalCount int `pg:"total_count"`
+}
+
+type RealmAuctionHouse struct {
+	RealmID        int16 `pg:"realm_id"`
+	AuctionHouseID int16 `pg:"auction_house_id"`
+}
+
+// BatchInsertError reports how far a batched insert got before a batch
+// failed. Outside a transaction, rows before RowsInserted were committed and
+// do not need resending.
+type BatchInsertError struct {
+	RowsInserted    int
+	BatchesInserted int
+	Err             error
+}
+
+func (e *BatchInsertError) Error() string {
+	return fmt.Sprintf("batch insert failed after %d rows (%d batches): %v", e.RowsInserted, e.BatchesInserted, e.Err)
+}
+
+func (e *BatchInsertError) Unwrap() error {
+	return e.Err
+}
+
+type VendorFlipQueryResult struct {
+	ItemID       int32  `pg:"item_id"`
+	ItemName     string `pg:"item_name"`
+	ItemMediaURL string `pg:"item_media_url"`
+	ItemRarity   string `pg:"item_rarity"`
+	Quantity     int32  `pg:"quantity"`
+	Min          int32  `pg:"min,use_zero"`
+	SellPrice    int32  `pg:"sell_price"`
+	Profit       int32  `pg:"profit"`
+}
+
+type AuctionHouseAvailability struct {
+	AuctionHouseID int16 `pg:"auction_house_id"`
+	Quantity       int64 `pg:"quantity"`
+	Min            int32 `pg:"min,use_zero"`
+}
+
+type ItemPriceComparison struct {
+	RealmID        int16 `pg:"realm_id"`
+	AuctionHouseID int16 `pg:"auction_house_id"`
+	Quantity       int32 `pg:"quantity"`
+	Min            int32 `pg:"min,use_zero"`
+}
+
+// CrossHouseArbitrage compares an item's lowest listing in two auction houses
+// of a realm. Listed is false for a house without a listing, in which case
+// its Min and Quantity are zero. Ratio is OppositeMin / Min and is only set
+// when both houses list the item.
+type CrossHouseArbitrage struct {
+	Min              int32   `pg:"min"`
+	Quantity         int32   `pg:"quantity"`
+	Listed           bool    `pg:"listed"`
+	OppositeMin      int32   `pg:"opposite_min"`
+	OppositeQuantity int32   `pg:"opposite_quantity"`
+	OppositeListed   bool    `pg:"opposite_listed"`
+	Ratio            float64 `pg:"-"`
+}
+
+type RarityBreakdown struct {
+	Listings int
+	Quantity int64
+}
+
+type rarityBreakdownRow struct {
+	Rarity   string `pg:"rarity"`
+	Listings int    `pg:"listings"`
+	Quantity int64  `pg:"quantity"`
+}
+
+// PriceAlert asks to be notified when an item's lowest listing in a house
+// drops below Threshold copper.
+type PriceAlert struct {
+	RealmID        int16
+	AuctionHouseID int16
+	ItemID         int32
+	Threshold      int32
+}
+
+type RealmItemAvailability struct {
+	TotalQuantity int64
+	Min           int32
+	AuctionHouses []AuctionHouseAvailability
 }
 
 type Item struct {
@@ -101,6 +468,79 @@ type Item struct {
 	RequiredLevel int16    `pg:"required_level"`
 	PurchasePrice int32    `pg:"purchase_price"`
 	SellPrice     int32    `pg:"sell_price"`
+	BindOnPickup  bool     `pg:"bind_on_pickup"`
+	// CreatedAt is set by the database when the item is first inserted and
+	// is never changed by UpsertItem.
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+type ConnectedRealm struct {
+	tableName struct{} `pg:"connected_realms"`
+	GroupID   int16    `pg:"group_id"`
+	RealmID   int16    `pg:"realm_id,pk"`
+}
+
+// ItemWithAvailability is an Item with whether it is currently listed on any
+// realm and auction house, and on how many realms.
+type ItemWithAvailability struct {
+	Item
+	Listed       bool `pg:"listed"`
+	ListedRealms int  `pg:"listed_realms"`
+}
+
+// ItemWithCurrentPrice is an item with its lowest current listing price and
+// listed quantity in a house. Both are zero and Listed is false when the item
+// isn't listed there.
+type ItemWithCurrentPrice struct {
+	Id       int32  `pg:"id"`
+	Name     string `pg:"name"`
+	MediaURL string `pg:"media_url"`
+	Rarity   string `pg:"rarity"`
+	Min      int32  `pg:"min,use_zero"`
+	Quantity int32  `pg:"quantity"`
+	Listed   bool   `pg:"listed"`
+}
+
+type ItemWithPriceAverageFlag struct {
+	Id              int32  `pg:"id"`
+	Name            string `pg:"name"`
+	MediaURL        string `pg:"media_url"`
+	Rarity          string `pg:"rarity"`
+	HasPriceAverage bool   `pg:"has_price_average"`
+}
+
+// ItemName is a localized item name. English names stay in items.name and
+// are the fallback when a locale has no entry.
+type ItemName struct {
+	tableName struct{} `pg:"item_names"`
+	ItemID    int32    `pg:"item_id,pk"`
+	Locale    string   `pg:"locale,pk"`
+	Name      string   `pg:"name"`
+}
+
+type ItemCategory struct {
+	tableName struct{} `pg:"item_categories"`
+	ItemID    int32    `pg:"item_id,pk"`
+	Category  string   `pg:"category,pk"`
+}
+
+// DatasetRefresh records when a wholesale-replaced table last received data
+// for a realm and auction house. Dataset is the name of the replaced table.
+// Generation starts at 1 and increases by one on every replace.
+type DatasetRefresh struct {
+	tableName      struct{}  `pg:"dataset_refreshes"`
+	RealmID        int16     `pg:"realm_id,pk"`
+	AuctionHouseID int16     `pg:"auction_house_id,pk"`
+	Dataset        string    `pg:"dataset,pk"`
+	RefreshedAt    time.Time `pg:"refreshed_at"`
+	Generation     int64     `pg:"generation"`
+}
+
+type RealmAuctionHouseStatus struct {
+	RealmID             int16     `pg:"realm_id"`
+	AuctionHouseID      int16     `pg:"auction_house_id"`
+	CurrentAuctionCount int       `pg:"current_auction_count,use_zero"`
+	LastReplacedAt      time.Time `pg:"last_replaced_at"`
 }
 
 type PriceDistribution struct {
@@ -112,6 +552,26 @@ type PriceDistribution struct {
 	Quantity       int32    `pg:"quantity"`
 }
 
+type NormalizedPriceDistribution struct {
+	BuyoutEach int32   `pg:"buyout_each,use_zero"`
+	Quantity   int32   `pg:"quantity"`
+	Share      float64 `pg:"share"`
+}
+
+type CumulativePriceDistribution struct {
+	BuyoutEach         int32 `pg:"buyout_each,use_zero"`
+	Quantity           int32 `pg:"quantity"`
+	CumulativeQuantity int64 `pg:"cumulative_quantity"`
+}
+
+// AveragedPriceDistribution is a bucket of a price distribution. BuyoutEach is
+// the quantity-weighted average of the bucket's prices and is kept fractional
+// so averaging doesn't introduce rounding to whole copper.
+type AveragedPriceDistribution struct {
+	BuyoutEach float64 `pg:"buyout_each,use_zero"`
+	Quantity   int64   `pg:"quantity"`
+}
+
 type priceDistributionTemp struct {
 	tableName      struct{} `pg:"price_distributions_temp"`
 	RealmID        int16    `pg:"realm_id,pk"`
@@ -147,6 +607,16 @@ type PriceAverage struct {
 	P90Current      int32    `pg:"p90_current"`
 	P90Average      int32    `pg:"p90_average"`
 	P90Percent      float32  `pg:"p90_percent"`
+	// SampleCount is the number of snapshots the averages were computed
+	// from.
+	SampleCount int32 `pg:"sample_count"`
+}
+
+type PriceAverageWithItem struct {
+	PriceAverage
+	ItemName     string `pg:"item_name"`
+	ItemMediaURL string `pg:"item_media_url"`
+	ItemRarity   string `pg:"item_rarity"`
 }
 
 type priceAverageTemp struct {
@@ -175,270 +645,2877 @@ type priceAverageTemp struct {
 	P90Current      int32    `pg:"p90_current"`
 	P90Average      int32    `pg:"p90_average"`
 	P90Percent      float32  `pg:"p90_percent"`
+	SampleCount     int32    `pg:"sample_count"`
+}
+
+type DatabaseOptions struct {
+	// ApplicationName is reported to Postgres and shown in pg_stat_activity.
+	// It overrides an application_name in the connection string; when both
+	// are empty it defaults to "auctions-db".
+	ApplicationName string
+	// StatementTimeout is set as statement_timeout on every connection so
+	// the server cancels any runaway query. It has millisecond precision;
+	// zero leaves the server's setting, which is unlimited by default. The
+	// Replace* methods lift it for their own long-running statements.
+	StatementTimeout time.Duration
+	// MinIdleConns is the number of idle connections the pool keeps open.
+	MinIdleConns int
+	// WarmUpTimeout, when set together with MinIdleConns, makes
+	// NewDatabaseWithOptions open the idle connections up front, waiting at
+	// most this long, so the first requests don't pay for dialing.
+	WarmUpTimeout time.Duration
+	// MaxRetries is how many times go-pg retries a statement that failed
+	// with a network error. Retries aren't needed to recover from a failover:
+	// go-pg discards a pooled connection once it fails with a network or
+	// FATAL error, so only the call that hit it fails and the next one dials
+	// afresh (see TestReconnectAfterBackendTerminated). Retrying also hides
+	// that one failure. Zero, the default, disables retries. A retried write
+	// may already have been applied, so this is unsafe for non-idempotent
+	// statements such as InsertAuctions, whose retry can fail on the rows
+	// the first attempt inserted. Only set it for read-only users.
+	MaxRetries int
 }
 
 func NewDatabase(connString string) (*Database, error) {
+	return NewDatabaseWithOptions(connString, DatabaseOptions{})
+}
+
+func NewDatabaseWithOptions(connString string, databaseOptions DatabaseOptions) (*Database, error) {
 	options, err := pg.ParseURL(connString)
 	if err != nil {
 		return nil, err
 	}
 
+	if databaseOptions.MaxRetries > 0 {
+		options.MaxRetries = databaseOptions.MaxRetries
+	}
+
+	if databaseOptions.ApplicationName != "" {
+		options.ApplicationName = databaseOptions.ApplicationName
+	} else if options.ApplicationName == "" {
+		options.ApplicationName = "auctions-db"
+	}
+
+	if databaseOptions.StatementTimeout > 0 {
+		timeout := databaseOptions.StatementTimeout.Milliseconds()
+		options.OnConnect = func(ctx context.Context, cn *pg.Conn) error {
+			_, err := cn.ExecContext(ctx, "SET statement_timeout = ?", timeout)
+			return err
+		}
+	}
+
+	if databaseOptions.MinIdleConns > 0 {
+		options.MinIdleConns = databaseOptions.MinIdleConns
+	}
+
 	db := pg.Connect(options)
 	ctx := context.Background()
 	if err := db.Ping(ctx); err != nil {
 		return nil, err
 	}
 
-	return &Database{
-		BatchSize: 1000,
-		db:        db,
-	}, nil
-}
+	database := &Database{
+		BatchSize:           1000,
+		DefaultDirection:    "asc",
+		statementTimeout:    databaseOptions.StatementTimeout,
+		currentAuctionStmts: newStmtPool(db, currentAuctionQuery, stmtPoolSize(db.Options().PoolSize)),
+		db:                  db,
+	}
 
-func (database *Database) GetRealms() ([]Realm, error) {
-	var realms []Realm
-	_, err := database.db.Query(&realms, "SELECT id,name FROM realms")
-	if err != nil {
-		return nil, err
+	if databaseOptions.WarmUpTimeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, databaseOptions.WarmUpTimeout)
+		defer cancel()
+		if err := database.WarmUp(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
-	return realms, nil
+
+	return database, nil
 }
 
-func (database *Database) GetAuctionHouses() ([]AuctionHouse, error) {
-	var auctionHouses []AuctionHouse
-	_, err := database.db.Query(&auctionHouses, "SELECT id,name FROM auction_houses")
-	if err != nil {
-		return nil, err
+// Close releases the prepared statements and closes the connection pool.
+// Copies made by the With* methods share the pool, so none of them can be
+// used afterwards.
+func (database *Database) Close() error {
+	if database.currentAuctionStmts != nil {
+		database.currentAuctionStmts.close()
 	}
-	return auctionHouses, nil
+	return database.db.Close()
 }
 
-func (database *Database) GetItem(itemId int32) (*Item, error) {
-	item := &Item{}
-	err := database.db.Model(item).Where("id = ?", itemId).Select()
-	if err != nil {
-		return nil, err
+// WarmUp opens the pool's MinIdleConns connections and returns them to the
+// pool, so they are ready before traffic arrives. It gives up when ctx is
+// done. With MinIdleConns unset it does nothing.
+func (database *Database) WarmUp(ctx context.Context) error {
+	conns := make([]*pg.Conn, 0, database.db.Options().MinIdleConns)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < cap(conns); i++ {
+		// Each Conn holds on to its connection until closed, so the pool
+		// has to dial a new one for every iteration.
+		conn := database.db.Conn()
+		conns = append(conns, conn)
+		_, err := conn.ExecContext(ctx, "SELECT 1")
+		if err != nil {
+			return err
+		}
 	}
-	return item, nil
+	return nil
 }
 
-func (database *Database) GetItemIDs() (map[int32]struct{}, error) {
-	var itemIds []int32
-	err := database.db.Model((*Item)(nil)).Column("id").Select(&itemIds)
-	if err != nil {
-		return nil, err
+// liftStatementTimeout disables the configured statement_timeout for the rest
+// of tx, for bulk work that is expected to outlast it.
+func (database *Database) liftStatementTimeout(tx *pg.Tx) error {
+	if database.statementTimeout <= 0 {
+		return nil
 	}
+	_, err := tx.Exec("SET LOCAL statement_timeout = 0")
+	return err
+}
 
-	itemsMap := make(map[int32]struct{}, len(itemIds))
-	for _, id := range itemIds {
-		itemsMap[id] = struct{}{}
+// conn returns the read transaction when running inside
+// WithReadTransaction and the pool otherwise.
+func (database *Database) conn() orm.DB {
+	if database.tx != nil {
+		return database.tx
 	}
+	return database.db
+}
 
-	return itemsMap, nil
+// WithReadTransaction runs fn inside a read-only REPEATABLE READ transaction.
+// The Database passed to fn reads through that transaction, so every read
+// sees the same snapshot even while a Replace* swap commits concurrently.
+func (database *Database) WithReadTransaction(ctx context.Context, fn func(database *Database) error) error {
+	return database.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		_, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY")
+		if err != nil {
+			return err
+		}
+
+		clone := *database
+		clone.tx = tx
+		return fn(&clone)
+	})
 }
 
-func (database *Database) GetSimilarItems(name string, limit int) ([]Item, error) {
-	var items []Item
-	_, err := database.db.Query(&items, `
-		SELECT id,name,media_url,rarity FROM items
-			WHERE name % ?
-			ORDER BY similarity(name, ?) DESC
-			LIMIT ?
-	`, name, name, limit)
-	if err != nil {
-		return nil, err
+// WithBatchSize returns a copy of the database that inserts in batches of
+// batchSize rows. Values below 1 are clamped to 1, as the batch loops can't
+// advance with an empty batch.
+func (database *Database) WithBatchSize(batchSize int) *Database {
+	if batchSize < 1 {
+		batchSize = 1
 	}
-	return items, nil
+	clone := *database
+	clone.BatchSize = batchSize
+	return &clone
 }
 
-func (database *Database) UpsertItem(item *Item) error {
-	_, err := database.db.Model(item).
-		OnConflict("(id) DO UPDATE").
-		Insert()
-	if err != nil {
-		return err
-	}
-	return nil
+// Tx exposes the write methods that can take part in a caller's
+// transaction. It is only valid inside the WithTransaction callback.
+type Tx struct {
+	BatchSize        int
+	ServerTimestamps bool
+	tx               *pg.Tx
 }
 
-func (database *Database) GetAuctions(interval int16, realmId int16, auctionHouseId int16, itemId int32, limit int16) ([]Auction, error) {
-	var auctions []Auction
-	_, err := database.db.Query(&auctions, `
-		SELECT timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
-		FROM auctions
-		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ?
-		ORDER BY timestamp DESC
-		LIMIT ?
-	`, interval, realmId, auctionHouseId, itemId, limit)
-	if err != nil {
-		return nil, err
-	}
-	return auctions, nil
+// WithTransaction runs fn inside a single transaction, committing if fn
+// returns nil and rolling back otherwise.
+func (database *Database) WithTransaction(ctx context.Context, fn func(tx *Tx) error) error {
+	return database.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return fn(&Tx{
+			BatchSize:        database.BatchSize,
+			ServerTimestamps: database.ServerTimestamps,
+			tx:               tx,
+		})
+	})
 }
 
-func (database *Database) GetCurrentAuctions(realmId int16, auctionHouseId int16, orderBy string, direction string, offset int32, limit int16) ([]CurrentAuctionQueryResult, error) {
-	var orderByQuery string
-	if orderBy == "p50" {
-		orderByQuery = "p50"
-	} else {
-		orderByQuery = "quantity"
-	}
+func (tx *Tx) InsertAuctions(auctions []*Auction) error {
+	return insertAuctions(tx.tx, tx.BatchSize, tx.ServerTimestamps, "", auctions)
+}
 
-	var directionQuery string
-	if direction == "desc" {
-		directionQuery = "DESC"
-	} else {
-		directionQuery = "ASC"
-	}
+func (tx *Tx) InsertAuctionsUpsert(auctions []*Auction) error {
+	return insertAuctions(tx.tx, tx.BatchSize, tx.ServerTimestamps, auctionsUpsertConflict, auctions)
+}
 
-	query := fmt.Sprintf(`
-		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity, 
-		       quantity, min, max, p05, p10, p25, p50, p75, p90
-		FROM current_auctions
-		INNER JOIN items ON item_id = items.id
-		WHERE realm_id = ? AND auction_house_id = ?
-		ORDER BY %s %s
-		OFFSET ? LIMIT ?
-	`, orderByQuery, directionQuery)
+func (tx *Tx) UpsertItem(item *Item) error {
+	return upsertItem(tx.tx, item)
+}
 
-	var currentAuctions []CurrentAuctionQueryResult
-	_, err := database.db.Query(&currentAuctions, query, realmId, auctionHouseId, offset, limit)
-	if err != nil {
-		return nil, err
-	}
+func (tx *Tx) MergeItem(item *Item) error {
+	return mergeItem(tx.tx, item)
+}
 
-	return currentAuctions, nil
+// stmtPoolSize is how many prepared copies of a hot query are kept for a
+// connection pool of poolSize. Each one pins a pooled connection until Close,
+// so they are limited to a quarter of the pool.
+func stmtPoolSize(poolSize int) int {
+	return max(1, poolSize/4)
 }
 
-func (database *Database) CountCurrentAuctions(realmId int16, auctionHouseId int16) (int, error) {
-	count, err := database.db.Model(&CurrentAuction{}).
-		Where("realm_id = ? and auction_house_id = ?", realmId, auctionHouseId).
-		Count()
-	if err != nil {
-		return 0, err
+// stmtPool reuses prepared statements for one query. A go-pg Stmt is bound to
+// the connection it was prepared on and serializes its callers, so the pool
+// keeps up to size statements, each on its own connection, and callers that
+// find them all busy run the query unprepared instead of waiting.
+type stmtPool struct {
+	db      *pg.DB
+	query   string
+	size    int32
+	created atomic.Int32
+	closed  atomic.Bool
+	stmts   chan *pg.Stmt
+}
+
+func newStmtPool(db *pg.DB, query string, size int) *stmtPool {
+	return &stmtPool{
+		db:    db,
+		query: query,
+		size:  int32(size),
+		stmts: make(chan *pg.Stmt, size),
 	}
-	return count, nil
 }
 
-func (database *Database) InsertAuctions(auctions []*Auction) error {
-	for i := 0; i < len(auctions); i += database.BatchSize {
-		end := i + database.BatchSize
-		if end > len(auctions) {
-			end = len(auctions)
+func (pool *stmtPool) queryOne(model interface{}, params ...interface{}) error {
+	var stmt *pg.Stmt
+	select {
+	case stmt = <-pool.stmts:
+	default:
+		if pool.created.Add(1) > pool.size {
+			pool.created.Add(-1)
+			_, err := pool.db.QueryOne(model, positionalQuery(pool.query), params...)
+			return err
 		}
-		batch := auctions[i:end]
-		_, err := database.db.Model(&batch).Insert()
+		var err error
+		stmt, err = pool.db.Prepare(pool.query)
 		if err != nil {
+			pool.created.Add(-1)
 			return err
 		}
 	}
 
-	return nil
+	_, err := stmt.QueryOne(model, params...)
+	if (err != nil && err != pg.ErrNoRows) || pool.closed.Load() {
+		// A failed statement's connection may be broken, and a closed pool
+		// keeps nothing, so the statement isn't reused.
+		stmt.Close()
+		pool.created.Add(-1)
+		return err
+	}
+	pool.stmts <- stmt
+	return err
 }
 
-func (database *Database) GetPriceDistributions(realmId int16, auctionHouseId int16, itemId int32) ([]PriceDistribution, error) {
-	var priceDistributions []PriceDistribution
-	_, err := database.db.Query(&priceDistributions, `
-		SELECT buyout_each, quantity
-		FROM price_distributions
-		WHERE realm_id = ? AND auction_house_id = ? AND item_id = ? ORDER BY buyout_each
-	`, realmId, auctionHouseId, itemId)
-	if err != nil {
-		return nil, err
+// close closes the idle statements and stops the pool from keeping the busy
+// ones once their callers finish.
+func (pool *stmtPool) close() {
+	pool.closed.Store(true)
+	for {
+		select {
+		case stmt := <-pool.stmts:
+			stmt.Close()
+		default:
+			return
+		}
 	}
-	return priceDistributions, nil
 }
 
-func (database *Database) GetPriceAverages(realmId int16, auctionHouseId int16, sortBy string, offset int32, limit int16) ([]PriceAverage, error) {
-	var directionQuery string
-	if sortBy == "high" {
-		directionQuery = "DESC"
-	} else {
-		directionQuery = "ASC"
-	}
+// positionalQuery rewrites a prepared statement's $n placeholders into
+// go-pg's ?n form for running it unprepared.
+func positionalQuery(query string) string {
+	return dollarPlaceholder.ReplaceAllStringFunc(query, func(placeholder string) string {
+		n, _ := strconv.Atoi(placeholder[1:])
+		return "?" + strconv.Itoa(n-1)
+	})
+}
 
-	query := fmt.Sprintf(`
-		SELECT item_id, quantity_current, quantity_average, quantity_percent, p05_current, p05_average, p05_percent, 
-		       p10_current, p10_average, p10_percent, p25_current, p25_average, p25_percent, p50_current, p50_average, 
-		       p50_percent, p75_current, p75_average, p75_percent, p90_current, p90_average, p90_percent
-		FROM price_averages
-		ORDER BY p05_percent %s
-		WHERE realm_id = ? AND auction_house_id = ?
-		OFFSET ? LIMIT ?
-	`, directionQuery)
+var dollarPlaceholder = regexp.MustCompile(`\$[0-9]+`)
 
-	var priceAverages []PriceAverage
-	_, err := database.db.Query(&priceAverages, query, realmId, auctionHouseId, offset, limit)
+type queryRecorder struct {
+	queries []string
+}
+
+func (recorder *queryRecorder) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (recorder *queryRecorder) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	query, err := event.FormattedQuery()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return priceAverages, nil
+	recorder.queries = append(recorder.queries, string(query))
+	return nil
 }
 
-func (database *Database) ReplacePriceDistributions(priceDistributions []*PriceDistribution) error {
-	priceDistributionsTemp := make([]*priceDistributionTemp, len(priceDistributions))
-	for i, v := range priceDistributions {
-		priceDistributionsTemp[i] = &priceDistributionTemp{
-			RealmID:        v.RealmID,
-			AuctionHouseID: v.AuctionHouseID,
-			ItemID:         v.ItemID,
-			BuyoutEach:     v.BuyoutEach,
-			Quantity:       v.Quantity,
+// ExplainAnalyze runs fn against a copy of the database that records the
+// queries it issues, then returns the EXPLAIN ANALYZE output of each SELECT
+// among them. Every recorded query runs twice, so this is meant for tuning
+// during development and requires Debug to be set.
+//
+//	plan, err := database.ExplainAnalyze(func(database *Database) error {
+//		_, err := database.GetCurrentAuctions(1, 2, CurrentAuctionFilter{}, "p50", "desc", 0, 50)
+//		return err
+//	})
+func (database *Database) ExplainAnalyze(fn func(database *Database) error) (string, error) {
+	if !database.Debug {
+		return "", errors.New("ExplainAnalyze requires Debug to be enabled")
+	}
+
+	recorder := &queryRecorder{}
+	clone := *database
+	// Prepared statements bypass the recorder's hooks, and their $n
+	// placeholders couldn't be explained anyway.
+	clone.currentAuctionStmts = nil
+	clone.db = database.db.WithContext(context.Background())
+	clone.db.AddQueryHook(recorder)
+	if err := fn(&clone); err != nil {
+		return "", err
+	}
+
+	var plans []string
+	for _, query := range recorder.queries {
+		trimmed := strings.ToUpper(strings.TrimSpace(query))
+		if !strings.HasPrefix(trimmed, "SELECT") && !strings.HasPrefix(trimmed, "WITH") {
+			continue
+		}
+
+		var lines []string
+		_, err := database.conn().Query(&lines, "EXPLAIN ANALYZE "+query)
+		if err != nil {
+			return "", err
+		}
+		plans = append(plans, strings.TrimSpace(query)+"\n\n"+strings.Join(lines, "\n"))
+	}
+	return strings.Join(plans, "\n\n"), nil
+}
+
+func (database *Database) reportBulkInsert(table string, rows int, start time.Time) {
+	if database.OnBulkInsert == nil {
+		return
+	}
+	batches := rows
+	if database.BatchSize > 0 {
+		batches = (rows + database.BatchSize - 1) / database.BatchSize
+	}
+	database.reportBulkInsertBatches(table, rows, batches, start)
+}
+
+func (database *Database) reportBulkInsertBatches(table string, rows int, batches int, start time.Time) {
+	if database.OnBulkInsert == nil {
+		return
+	}
+	database.OnBulkInsert(BulkStats{
+		Table:        table,
+		RowsInserted: rows,
+		BatchCount:   batches,
+		Duration:     time.Since(start),
+	})
+}
+
+// GetRealms returns all realms, or only the enabled ones when onlyEnabled is
+// set. Disabled realms are deprecated or offline and shouldn't be offered for
+// selection.
+func (database *Database) GetRealms(onlyEnabled bool) ([]Realm, error) {
+	var whereQuery string
+	if onlyEnabled {
+		whereQuery = "WHERE enabled"
+	}
+
+	var realms []Realm
+	_, err := database.conn().Query(&realms, "SELECT id,name,enabled FROM realms "+whereQuery)
+	if err != nil {
+		return nil, err
+	}
+	return realms, nil
+}
+
+func (database *Database) UpsertRealm(realm *Realm) error {
+	_, err := database.conn().Model(realm).
+		OnConflict("(id) DO UPDATE").
+		Insert()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (database *Database) GetRealmsByIDs(ids []int16) ([]Realm, error) {
+	if len(ids) == 0 {
+		return []Realm{}, nil
+	}
+
+	var realms []Realm
+	_, err := database.conn().Query(&realms, "SELECT id,name,enabled FROM realms WHERE id IN (?)", pg.In(ids))
+	if err != nil {
+		return nil, err
+	}
+	return realms, nil
+}
+
+func (database *Database) GetConnectedRealms(groupId int16) ([]int16, error) {
+	var realmIds []int16
+	err := database.conn().Model((*ConnectedRealm)(nil)).
+		Column("realm_id").
+		Where("group_id = ?", groupId).
+		Order("realm_id").
+		Select(&realmIds)
+	if err != nil {
+		return nil, err
+	}
+	return realmIds, nil
+}
+
+// SetConnectedRealms makes realmIds the exact membership of groupId. A realm
+// belongs to at most one group, so realms listed here move out of any other
+// group they were in.
+func (database *Database) SetConnectedRealms(groupId int16, realmIds []int16) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Model((*ConnectedRealm)(nil)).Where("group_id = ?", groupId).Delete()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if len(realmIds) > 0 {
+		connectedRealms := make([]*ConnectedRealm, len(realmIds))
+		for i, realmId := range realmIds {
+			connectedRealms[i] = &ConnectedRealm{
+				GroupID: groupId,
+				RealmID: realmId,
+			}
+		}
+
+		_, err = tx.Model(&connectedRealms).OnConflict("(realm_id) DO UPDATE").Insert()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (database *Database) GetAuctionHouses() ([]AuctionHouse, error) {
+	var auctionHouses []AuctionHouse
+	_, err := database.conn().Query(&auctionHouses, "SELECT id,name FROM auction_houses")
+	if err != nil {
+		return nil, err
+	}
+	return auctionHouses, nil
+}
+
+// GetAuctionHousesWithCounts returns every auction house with the number of
+// items currently listed in it on realmId. Houses without listings have a
+// count of zero.
+func (database *Database) GetAuctionHousesWithCounts(realmId int16) ([]AuctionHouseWithCount, error) {
+	var auctionHouses []AuctionHouseWithCount
+	_, err := database.conn().Query(&auctionHouses, `
+		SELECT auction_houses.id, auction_houses.name, COUNT(current_auctions.item_id) AS item_count
+		FROM auction_houses
+		LEFT JOIN current_auctions ON current_auctions.auction_house_id = auction_houses.id
+			AND current_auctions.realm_id = ?
+		GROUP BY auction_houses.id, auction_houses.name
+		ORDER BY auction_houses.id
+	`, realmId)
+	if err != nil {
+		return nil, err
+	}
+	return auctionHouses, nil
+}
+
+type realmHouseExistence struct {
+	RealmExists        bool `pg:"realm_exists"`
+	AuctionHouseExists bool `pg:"auction_house_exists"`
+}
+
+// ValidateRealmHouse reports whether both the realm and the auction house
+// exist, checking the two in one round trip. When one is missing it returns
+// false with ErrRealmNotFound or ErrAuctionHouseNotFound, the realm being
+// checked first; any other error is a query failure. Disabled realms count as
+// existing.
+func (database *Database) ValidateRealmHouse(realmId int16, auctionHouseId int16) (bool, error) {
+	existence := &realmHouseExistence{}
+	_, err := database.conn().QueryOne(existence, `
+		SELECT EXISTS (SELECT 1 FROM realms WHERE id = ?) AS realm_exists,
+		       EXISTS (SELECT 1 FROM auction_houses WHERE id = ?) AS auction_house_exists
+	`, realmId, auctionHouseId)
+	if err != nil {
+		return false, err
+	}
+
+	if !existence.RealmExists {
+		return false, ErrRealmNotFound
+	}
+	if !existence.AuctionHouseExists {
+		return false, ErrAuctionHouseNotFound
+	}
+	return true, nil
+}
+
+func (database *Database) GetItem(itemId int32) (*Item, error) {
+	item := &Item{}
+	err := database.conn().Model(item).Where("id = ?", itemId).Select()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (database *Database) GetItemWithAvailability(itemId int32) (*ItemWithAvailability, error) {
+	item := &ItemWithAvailability{}
+	_, err := database.conn().QueryOne(item, `
+		SELECT items.*, listings.realms > 0 AS listed, listings.realms AS listed_realms
+		FROM items, (
+			SELECT COUNT(DISTINCT realm_id) AS realms
+			FROM current_auctions
+			WHERE item_id = ?0
+		) AS listings
+		WHERE items.id = ?0
+	`, itemId)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// GetItemLocalized is GetItem with Name translated to locale, falling back to
+// the English name when no translation exists.
+func (database *Database) GetItemLocalized(itemId int32, locale string) (*Item, error) {
+	item := &Item{}
+	_, err := database.conn().QueryOne(item, `
+		SELECT items.id, COALESCE(item_names.name, items.name) AS name, items.media_url, items.rarity, items.level,
+		       items.required_level, items.purchase_price, items.sell_price, items.bind_on_pickup, items.created_at
+		FROM items
+		LEFT JOIN item_names ON item_names.item_id = items.id AND item_names.locale = ?
+		WHERE items.id = ?
+	`, locale, itemId)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (database *Database) UpsertItemName(itemName *ItemName) error {
+	_, err := database.conn().Model(itemName).
+		OnConflict("(item_id, locale) DO UPDATE").
+		Insert()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetItemByName returns the item whose name matches exactly, ignoring case.
+// When several items share a name the one with the lowest id is returned. If
+// nothing matches the error is pg.ErrNoRows.
+func (database *Database) GetItemByName(name string) (*Item, error) {
+	item := &Item{}
+	err := database.conn().Model(item).
+		Where("lower(name) = lower(?)", name).
+		Order("id").
+		Limit(1).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (database *Database) GetItemIDs() (map[int32]struct{}, error) {
+	var itemIds []int32
+	err := database.conn().Model((*Item)(nil)).Column("id").Select(&itemIds)
+	if err != nil {
+		return nil, err
+	}
+
+	itemsMap := make(map[int32]struct{}, len(itemIds))
+	for _, id := range itemIds {
+		itemsMap[id] = struct{}{}
+	}
+
+	return itemsMap, nil
+}
+
+// GetSimilarItems returns items ranked by trigram similarity to name. An
+// exact case-insensitive match always comes first, followed by names that
+// start with name, then the remaining fuzzy matches.
+func (database *Database) GetSimilarItems(name string, limit int, tradeableOnly bool) ([]Item, error) {
+	var tradeableQuery string
+	if tradeableOnly {
+		tradeableQuery = "AND NOT bind_on_pickup"
+	}
+
+	query := `
+		SELECT id,name,media_url,rarity,bind_on_pickup FROM items
+			WHERE (name % ?0 OR name ILIKE ?1 OR name ILIKE ?2) ` + tradeableQuery + `
+			ORDER BY name ILIKE ?1 DESC, name ILIKE ?2 DESC, similarity(name, ?0) DESC
+			LIMIT ?3
+	`
+
+	exact := escapeLike(name)
+	var items []Item
+	_, err := database.conn().Query(&items, query, name, exact, exact+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetSimilarItemsInLocale is GetSimilarItems matching against the names
+// translated to locale. Items without a translation in that locale are not
+// matched; their Name in the result is the translated one.
+func (database *Database) GetSimilarItemsInLocale(name string, locale string, limit int, tradeableOnly bool) ([]Item, error) {
+	var tradeableQuery string
+	if tradeableOnly {
+		tradeableQuery = "AND NOT bind_on_pickup"
+	}
+
+	query := `
+		SELECT id,item_names.name,media_url,rarity,bind_on_pickup FROM items
+			INNER JOIN item_names ON item_names.item_id = items.id AND item_names.locale = ?4
+			WHERE (item_names.name % ?0 OR item_names.name ILIKE ?1 OR item_names.name ILIKE ?2) ` + tradeableQuery + `
+			ORDER BY item_names.name ILIKE ?1 DESC, item_names.name ILIKE ?2 DESC, similarity(item_names.name, ?0) DESC
+			LIMIT ?3
+	`
+
+	exact := escapeLike(name)
+	var items []Item
+	_, err := database.conn().Query(&items, query, name, exact, exact+"%", limit, locale)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetSimilarListedItems searches only items currently listed on the given
+// realm and auction house. With a zero realm or auction house it falls back
+// to searching the whole catalog.
+func (database *Database) GetSimilarListedItems(name string, realmId int16, auctionHouseId int16, limit int) ([]Item, error) {
+	if realmId == 0 || auctionHouseId == 0 {
+		return database.GetSimilarItems(name, limit, false)
+	}
+
+	var items []Item
+	_, err := database.conn().Query(&items, `
+		SELECT id,name,media_url,rarity,bind_on_pickup FROM items
+			INNER JOIN current_auctions ON current_auctions.item_id = items.id
+			WHERE realm_id = ? AND auction_house_id = ? AND name % ?
+			ORDER BY similarity(name, ?) DESC
+			LIMIT ?
+	`, realmId, auctionHouseId, name, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+type similarItemRow struct {
+	Query    string `pg:"query"`
+	Id       int32  `pg:"id"`
+	Name     string `pg:"name"`
+	MediaURL string `pg:"media_url"`
+	Rarity   string `pg:"rarity"`
+}
+
+func (database *Database) GetSimilarItemsBatch(names []string, limitPerName int) (map[string][]Item, error) {
+	results := make(map[string][]Item, len(names))
+	if len(names) == 0 {
+		return results, nil
+	}
+
+	// Results are keyed by name, so a repeated name would collect its
+	// matches twice.
+	seen := make(map[string]bool, len(names))
+	var uniqueNames []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			uniqueNames = append(uniqueNames, name)
+		}
+	}
+
+	var rows []similarItemRow
+	_, err := database.conn().Query(&rows, `
+		SELECT queries.name AS query, matches.id, matches.name, matches.media_url, matches.rarity
+		FROM unnest(?::text[]) WITH ORDINALITY AS queries(name, position)
+		CROSS JOIN LATERAL (
+			SELECT id, name, media_url, rarity, similarity(items.name, queries.name) AS score
+			FROM items
+			WHERE items.name % queries.name
+			ORDER BY score DESC
+			LIMIT ?
+		) matches
+		ORDER BY queries.position, matches.score DESC
+	`, pg.Array(uniqueNames), limitPerName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		results[row.Query] = append(results[row.Query], Item{
+			Id:       row.Id,
+			Name:     row.Name,
+			MediaURL: row.MediaURL,
+			Rarity:   row.Rarity,
+		})
+	}
+	return results, nil
+}
+
+const minPatternLiteralLength = 3
+
+// wildcardToILike translates a shell-style pattern, where * matches any run of
+// characters and ? matches one character, into an ILIKE pattern. Literal %,
+// _ and \ are escaped. It also returns the number of literal characters.
+func wildcardToILike(pattern string) (string, int) {
+	var builder strings.Builder
+	literals := 0
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			builder.WriteRune('%')
+		case '?':
+			builder.WriteRune('_')
+		case '%', '_', '\\':
+			builder.WriteRune('\\')
+			builder.WriteRune(r)
+			literals++
+		default:
+			builder.WriteRune(r)
+			literals++
+		}
+	}
+	return builder.String(), literals
+}
+
+// GetItemsByPattern finds items whose name matches a shell-style wildcard
+// pattern such as "*Potion of*", ignoring case. Patterns need at least three
+// non-wildcard characters so they can't match the whole catalog.
+func (database *Database) GetItemsByPattern(pattern string, limit int) ([]Item, error) {
+	likePattern, literals := wildcardToILike(pattern)
+	if literals < minPatternLiteralLength {
+		return nil, fmt.Errorf("pattern must contain at least %d non-wildcard characters: %q", minPatternLiteralLength, pattern)
+	}
+
+	var items []Item
+	err := database.conn().Model(&items).
+		Where("name ILIKE ?", likePattern).
+		Order("name").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) GetItemsByLevelRange(minLevel int16, maxLevel int16, offset int32, limit int16) ([]Item, error) {
+	var items []Item
+	query := database.conn().Model(&items).Where("level >= ?", minLevel)
+	if maxLevel > 0 {
+		query = query.Where("level <= ?", maxLevel)
+	}
+
+	err := query.Order("level", "name").Offset(int(offset)).Limit(int(limit)).Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) GetItemsMissingMedia(offset int32, limit int16) ([]Item, error) {
+	var items []Item
+	err := database.conn().Model(&items).
+		Where("media_url IS NULL OR media_url = ''").
+		Order("id").
+		Offset(int(offset)).
+		Limit(int(limit)).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetItemsBySellValue browses the catalog by vendor sell price. Items that
+// can't be sold to a vendor sort last in either direction.
+func (database *Database) GetItemsBySellValue(offset int32, limit int16, descending bool) ([]Item, error) {
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+
+	var items []Item
+	err := database.conn().Model(&items).
+		OrderExpr("COALESCE(sell_price, 0) = 0").
+		OrderExpr("sell_price " + direction).
+		Order("id").
+		Offset(int(offset)).
+		Limit(int(limit)).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetRecentlyAddedItems returns the items most recently seen for the first
+// time, newest first.
+func (database *Database) GetRecentlyAddedItems(limit int16) ([]Item, error) {
+	var items []Item
+	err := database.conn().Model(&items).
+		Order("created_at DESC", "id DESC").
+		Limit(int(limit)).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) GetItemsWithPriceAverageFlag(realmId int16, auctionHouseId int16, itemIds []int32) ([]ItemWithPriceAverageFlag, error) {
+	if len(itemIds) == 0 {
+		return []ItemWithPriceAverageFlag{}, nil
+	}
+
+	var items []ItemWithPriceAverageFlag
+	_, err := database.conn().Query(&items, `
+		SELECT items.id, items.name, items.media_url, items.rarity, price_averages.item_id IS NOT NULL AS has_price_average
+		FROM items
+		LEFT JOIN price_averages ON price_averages.item_id = items.id
+			AND price_averages.realm_id = ? AND price_averages.auction_house_id = ?
+		WHERE items.id IN (?)
+		ORDER BY items.id
+	`, realmId, auctionHouseId, pg.In(itemIds))
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) GetItemsWithCurrentPrice(realmId int16, auctionHouseId int16, itemIds []int32) ([]ItemWithCurrentPrice, error) {
+	if len(itemIds) == 0 {
+		return []ItemWithCurrentPrice{}, nil
+	}
+
+	var items []ItemWithCurrentPrice
+	_, err := database.conn().Query(&items, `
+		SELECT items.id, items.name, items.media_url, items.rarity,
+		       COALESCE(current_auctions.min, 0) AS min, COALESCE(current_auctions.quantity, 0) AS quantity,
+		       current_auctions.item_id IS NOT NULL AS listed
+		FROM items
+		LEFT JOIN current_auctions ON current_auctions.item_id = items.id
+			AND current_auctions.realm_id = ? AND current_auctions.auction_house_id = ?
+		WHERE items.id IN (?)
+		ORDER BY items.id
+	`, realmId, auctionHouseId, pg.In(itemIds))
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) UpsertItem(item *Item) error {
+	return upsertItem(database.db, item)
+}
+
+// MergeItem is UpsertItem for sources that only know some of an item's
+// fields. On insert it behaves like UpsertItem; when the item exists, only
+// fields that are non-zero in item are written and the rest keep their
+// stored values. Zero means "unknown" for every field, so MergeItem can't
+// clear a field or set BindOnPickup to false; use UpsertItem for that.
+func (database *Database) MergeItem(item *Item) error {
+	return mergeItem(database.db, item)
+}
+
+func mergeItem(db orm.DB, item *Item) error {
+	var set []string
+	for _, field := range []struct {
+		column string
+		zero   bool
+	}{
+		{"name", item.Name == ""},
+		{"media_url", item.MediaURL == ""},
+		{"rarity", item.Rarity == ""},
+		{"level", item.Level == 0},
+		{"required_level", item.RequiredLevel == 0},
+		{"purchase_price", item.PurchasePrice == 0},
+		{"sell_price", item.SellPrice == 0},
+		{"bind_on_pickup", !item.BindOnPickup},
+	} {
+		if !field.zero {
+			set = append(set, fmt.Sprintf("%[1]s = EXCLUDED.%[1]s", field.column))
+		}
+	}
+
+	query := db.Model(item)
+	if len(set) == 0 {
+		query = query.OnConflict("(id) DO NOTHING")
+	} else {
+		query = query.OnConflict("(id) DO UPDATE").Set(strings.Join(set, ", "))
+	}
+	_, err := query.Insert()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func upsertItem(db orm.DB, item *Item) error {
+	_, err := db.Model(item).
+		OnConflict("(id) DO UPDATE").
+		Set("name = EXCLUDED.name, media_url = EXCLUDED.media_url, rarity = EXCLUDED.rarity").
+		Set("level = EXCLUDED.level, required_level = EXCLUDED.required_level").
+		Set("purchase_price = EXCLUDED.purchase_price, sell_price = EXCLUDED.sell_price").
+		Set("bind_on_pickup = EXCLUDED.bind_on_pickup").
+		Insert()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (database *Database) GetItemCategories(itemId int32) ([]string, error) {
+	var categories []string
+	err := database.conn().Model((*ItemCategory)(nil)).
+		Column("category").
+		Where("item_id = ?", itemId).
+		Order("category").
+		Select(&categories)
+	if err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+func (database *Database) SetItemCategories(itemId int32, categories []string) error {
+	tx, err := database.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Model((*ItemCategory)(nil)).Where("item_id = ?", itemId).Delete()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if len(categories) > 0 {
+		itemCategories := make([]*ItemCategory, len(categories))
+		for i, category := range categories {
+			itemCategories[i] = &ItemCategory{
+				ItemID:   itemId,
+				Category: category,
+			}
+		}
+
+		_, err = tx.Model(&itemCategories).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (database *Database) GetAuctions(interval Interval, realmId int16, auctionHouseId int16, itemId int32, offset int32, limit int16) ([]Auction, error) {
+	var auctions []Auction
+	_, err := database.conn().Query(&auctions, `
+		SELECT timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ?
+		ORDER BY timestamp DESC
+		OFFSET ? LIMIT ?
+	`, interval, realmId, auctionHouseId, itemId, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return auctions, nil
+}
+
+// GetAuctionColumns is GetAuctions in columnar form. It selects the same
+// snapshots, newest first for offset and limit, but returns them oldest
+// first as charts expect.
+func (database *Database) GetAuctionColumns(interval Interval, realmId int16, auctionHouseId int16, itemId int32, offset int32, limit int16) (*AuctionColumns, error) {
+	columns := &AuctionColumns{}
+	_, err := database.conn().QueryOne(columns, `
+		SELECT COALESCE(array_agg(timestamp ORDER BY timestamp), '{}') AS timestamps,
+		       COALESCE(array_agg(quantity ORDER BY timestamp), '{}') AS quantity,
+		       COALESCE(array_agg(min ORDER BY timestamp), '{}') AS min,
+		       COALESCE(array_agg(max ORDER BY timestamp), '{}') AS max,
+		       COALESCE(array_agg(p05 ORDER BY timestamp), '{}') AS p05,
+		       COALESCE(array_agg(p10 ORDER BY timestamp), '{}') AS p10,
+		       COALESCE(array_agg(p25 ORDER BY timestamp), '{}') AS p25,
+		       COALESCE(array_agg(p50 ORDER BY timestamp), '{}') AS p50,
+		       COALESCE(array_agg(p75 ORDER BY timestamp), '{}') AS p75,
+		       COALESCE(array_agg(p90 ORDER BY timestamp), '{}') AS p90
+		FROM (
+			SELECT timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+			FROM auctions
+			WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ?
+			ORDER BY timestamp DESC
+			OFFSET ? LIMIT ?
+		) AS snapshots
+	`, interval, realmId, auctionHouseId, itemId, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// currentAuctionsOrderBy builds the ORDER BY clause for the current auction
+// listings. An orderBy of "none" omits ordering entirely for bulk exports
+// that do not care about row order. An empty direction falls back to
+// DefaultDirection.
+func (database *Database) currentAuctionsOrderBy(orderBy string, direction string) string {
+	if orderBy == "none" {
+		return ""
+	}
+	if direction == "" {
+		direction = database.DefaultDirection
+	}
+
+	var orderByQuery string
+	if orderBy == "p50" {
+		orderByQuery = "p50"
+	} else {
+		orderByQuery = "quantity"
+	}
+
+	var directionQuery string
+	if direction == "desc" {
+		directionQuery = "DESC"
+	} else {
+		directionQuery = "ASC"
+	}
+
+	return fmt.Sprintf("ORDER BY %s %s, item_id ASC", orderByQuery, directionQuery)
+}
+
+func currentAuctionsWhere(realmId int16, auctionHouseId int16, filter CurrentAuctionFilter) (string, []interface{}, error) {
+	conditions := []string{"realm_id = ?", "auction_house_id = ?"}
+	params := []interface{}{realmId, auctionHouseId}
+	return currentAuctionsFilterWhere(conditions, params, filter)
+}
+
+func currentAuctionsFilterWhere(conditions []string, params []interface{}, filter CurrentAuctionFilter) (string, []interface{}, error) {
+	if filter.MinRarity != "" {
+		rank, ok := rarityRanks[strings.ToLower(filter.MinRarity)]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown rarity: %s", filter.MinRarity)
+		}
+		conditions = append(conditions, rarityRankQuery+" >= ?")
+		params = append(params, rank)
+	}
+
+	if filter.Category != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM item_categories WHERE item_categories.item_id = current_auctions.item_id AND category = ?)")
+		params = append(params, filter.Category)
+	}
+
+	return strings.Join(conditions, " AND "), params, nil
+}
+
+func (database *Database) GetAuctionsForItems(interval Interval, realmId int16, auctionHouseId int16, itemIds []int32, from int32, to int32) ([]Auction, error) {
+	if len(itemIds) == 0 {
+		return []Auction{}, nil
+	}
+
+	var auctions []Auction
+	_, err := database.conn().Query(&auctions, `
+		SELECT item_id, timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id IN (?)
+			AND timestamp BETWEEN ? AND ?
+		ORDER BY item_id, timestamp
+	`, interval, realmId, auctionHouseId, pg.In(itemIds), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return auctions, nil
+}
+
+func (database *Database) GetAuctionsByItemAcrossHouses(interval Interval, realmId int16, itemId int32, from int32, to int32) ([]Auction, error) {
+	var auctions []Auction
+	_, err := database.conn().Query(&auctions, `
+		SELECT auction_house_id, timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND item_id = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY auction_house_id, timestamp
+	`, interval, realmId, itemId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return auctions, nil
+}
+
+func (database *Database) GetAuctionsDelta(interval Interval, realmId int16, auctionHouseId int16, itemId int32, ts1 int32, ts2 int32) (*AuctionDelta, error) {
+	var auctions []Auction
+	_, err := database.conn().Query(&auctions, `
+		SELECT timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ? AND timestamp IN (?, ?)
+	`, interval, realmId, auctionHouseId, itemId, ts1, ts2)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[int32]Auction, len(auctions))
+	for _, auction := range auctions {
+		snapshots[auction.Timestamp] = auction
+	}
+	from, ok := snapshots[ts1]
+	if !ok {
+		return nil, fmt.Errorf("no auction snapshot at timestamp %d", ts1)
+	}
+	to, ok := snapshots[ts2]
+	if !ok {
+		return nil, fmt.Errorf("no auction snapshot at timestamp %d", ts2)
+	}
+
+	return &AuctionDelta{
+		From:     ts1,
+		To:       ts2,
+		Quantity: to.Quantity - from.Quantity,
+		Min:      to.Min - from.Min,
+		Max:      to.Max - from.Max,
+		P05:      to.P05 - from.P05,
+		P10:      to.P10 - from.P10,
+		P25:      to.P25 - from.P25,
+		P50:      to.P50 - from.P50,
+		P75:      to.P75 - from.P75,
+		P90:      to.P90 - from.P90,
+	}, nil
+}
+
+// GetWeightedPriceSeries returns an item's p50 series smoothed by weighting
+// each point with its quantity over a trailing window of window points, so
+// thinly traded snapshots move the line less. Points whose window has no
+// quantity fall back to their raw p50.
+func (database *Database) GetWeightedPriceSeries(interval Interval, realmId int16, auctionHouseId int16, itemId int32, from int32, to int32, window int16) ([]WeightedPricePoint, error) {
+	if window < 1 {
+		return nil, fmt.Errorf("window must be at least 1: %d", window)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT timestamp, quantity, COALESCE(
+			SUM(p50::bigint * quantity) OVER samples / NULLIF(SUM(quantity) OVER samples, 0)::float8,
+			p50
+		) AS weighted_p50
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ? AND timestamp BETWEEN ? AND ?
+		WINDOW samples AS (ORDER BY timestamp ROWS BETWEEN %d PRECEDING AND CURRENT ROW)
+		ORDER BY timestamp
+	`, window-1)
+
+	var points []WeightedPricePoint
+	_, err := database.conn().Query(&points, query, interval, realmId, auctionHouseId, itemId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// GetMovingAverageSeries returns an item's p50 series over [from, to] with
+// the average of each point and the window-1 points before it. Points near
+// the start average over the points available, so a window longer than the
+// series yields a running average.
+func (database *Database) GetMovingAverageSeries(interval Interval, realmId int16, auctionHouseId int16, itemId int32, from int32, to int32, window int16) ([]MovingAveragePoint, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid time range: %d > %d", from, to)
+	}
+	if window < 1 {
+		return nil, fmt.Errorf("window must be at least 1: %d", window)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT timestamp, p50, AVG(p50) OVER (ORDER BY timestamp ROWS BETWEEN %d PRECEDING AND CURRENT ROW) AS moving_average
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY timestamp
+	`, window-1)
+
+	var points []MovingAveragePoint
+	_, err := database.conn().Query(&points, query, interval, realmId, auctionHouseId, itemId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// GetMinPriceSeries returns the lowest listing price of an item over
+// [from, to], oldest first. A positive step downsamples the series into
+// step-second buckets, each reporting the lowest price seen in it at the
+// bucket's start time; zero returns every snapshot.
+func (database *Database) GetMinPriceSeries(interval Interval, realmId int16, auctionHouseId int16, itemId int32, from int32, to int32, step int32) ([]MinPricePoint, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid time range: %d > %d", from, to)
+	}
+	if step < 0 {
+		return nil, fmt.Errorf("step must not be negative: %d", step)
+	}
+
+	bucket := "timestamp"
+	if step > 0 {
+		bucket = fmt.Sprintf("timestamp - timestamp %% %d", step)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s AS timestamp, MIN(min) AS min
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ? AND timestamp BETWEEN ? AND ?
+		GROUP BY 1
+		ORDER BY 1
+	`, bucket)
+
+	var points []MinPricePoint
+	_, err := database.conn().Query(&points, query, interval, realmId, auctionHouseId, itemId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// GetRecentAuctionsForItems returns the newest pointsPerItem snapshots of
+// each item in one query, keyed by item and ordered newest first like
+// GetAuctions. Items without snapshots are absent from the map.
+func (database *Database) GetRecentAuctionsForItems(interval Interval, realmId int16, auctionHouseId int16, itemIds []int32, pointsPerItem int16) (map[int32][]Auction, error) {
+	if len(itemIds) == 0 {
+		return map[int32][]Auction{}, nil
+	}
+
+	var auctions []Auction
+	_, err := database.conn().Query(&auctions, `
+		SELECT item_id, timestamp, quantity, min, p05, p10, p25, p50, p75, p90, max
+		FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY item_id ORDER BY timestamp DESC) AS position
+			FROM auctions
+			WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id IN (?)
+		) AS ranked
+		WHERE position <= ?
+		ORDER BY item_id, timestamp DESC
+	`, interval, realmId, auctionHouseId, pg.In(itemIds), pointsPerItem)
+	if err != nil {
+		return nil, err
+	}
+
+	auctionsByItem := make(map[int32][]Auction, len(itemIds))
+	for _, auction := range auctions {
+		itemId := int32(auction.ItemID)
+		auctionsByItem[itemId] = append(auctionsByItem[itemId], auction)
+	}
+	return auctionsByItem, nil
+}
+
+// GetOldestAuctionTimestamp returns the earliest snapshot timestamp stored for
+// interval across all realms and houses, or 0 when there is none.
+func (database *Database) GetOldestAuctionTimestamp(interval Interval) (int32, error) {
+	return database.auctionTimestampBound("MIN", interval)
+}
+
+// GetLatestAuctionTimestamp returns the most recent snapshot timestamp stored
+// for interval across all realms and houses, or 0 when there is none.
+func (database *Database) GetLatestAuctionTimestamp(interval Interval) (int32, error) {
+	return database.auctionTimestampBound("MAX", interval)
+}
+
+func (database *Database) auctionTimestampBound(aggregate string, interval Interval) (int32, error) {
+	var timestamp int32
+	query := fmt.Sprintf("SELECT COALESCE(%s(timestamp), 0) FROM auctions WHERE interval = ?", aggregate)
+	_, err := database.conn().QueryOne(pg.Scan(&timestamp), query, interval)
+	if err != nil {
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+func (database *Database) GetAuctionTimestamps(interval Interval, realmId int16, auctionHouseId int16, itemId int32, limit int16) ([]int32, error) {
+	var timestamps []int32
+	_, err := database.conn().Query(&timestamps, `
+		SELECT DISTINCT timestamp
+		FROM auctions
+		WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ?
+		ORDER BY timestamp DESC
+		LIMIT ?
+	`, interval, realmId, auctionHouseId, itemId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return timestamps, nil
+}
+
+// priceColumn selects a price column of auctions, reading 0 as NULL when
+// ZeroPricesAsNull is set.
+func (database *Database) priceColumn(column string) string {
+	if database.ZeroPricesAsNull {
+		return fmt.Sprintf("NULLIF(%[1]s, 0) AS %[1]s", column)
+	}
+	return column
+}
+
+// GetAuctionsAsTimeSeries returns one point per step-second period over
+// [from, to], oldest first. step is normally the interval's snapshot period.
+// Periods start at multiples of step, like GetMinPriceSeries buckets, and each
+// point carries the latest snapshot taken within its period, so snapshots
+// written a little off the boundary still land in their period. Periods
+// without a snapshot are filled according to fill.
+func (database *Database) GetAuctionsAsTimeSeries(interval Interval, realmId int16, auctionHouseId int16, itemId int32, from int32, to int32, step int32, fill FillStrategy) ([]AuctionSeriesPoint, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid time range: %d > %d", from, to)
+	}
+	if step < 1 {
+		return nil, fmt.Errorf("step must be at least 1: %d", step)
+	}
+
+	var priceColumns []string
+	for _, column := range []string{"min", "max", "p05", "p10", "p25", "p50", "p75", "p90"} {
+		priceColumns = append(priceColumns, database.priceColumn(column))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT series.timestamp, quantity, min, max, p05, p10, p25, p50, p75, p90
+		FROM generate_series(?::int, ?::int, ?::int) AS series(timestamp)
+		LEFT JOIN LATERAL (
+			SELECT quantity, %s
+			FROM auctions
+			WHERE interval = ? AND realm_id = ? AND auction_house_id = ? AND item_id = ?
+				AND timestamp >= series.timestamp AND timestamp < series.timestamp + ?
+				AND timestamp BETWEEN ? AND ?
+			ORDER BY timestamp DESC
+			LIMIT 1
+		) AS auctions ON true
+		ORDER BY series.timestamp
+	`, strings.Join(priceColumns, ", "))
+
+	var points []AuctionSeriesPoint
+	_, err := database.conn().Query(&points, query, from-from%step, to, step,
+		interval, realmId, auctionHouseId, itemId, step, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if fill == FillPrevious {
+		for i := 1; i < len(points); i++ {
+			if points[i].Quantity == nil {
+				timestamp := points[i].Timestamp
+				points[i] = points[i-1]
+				points[i].Timestamp = timestamp
+			}
+		}
+	}
+
+	return points, nil
+}
+
+func (database *Database) GetMostTradedItems(interval Interval, realmId int16, auctionHouseId int16, lookback int32, limit int16) ([]TradedItemQueryResult, error) {
+	var items []TradedItemQueryResult
+	_, err := database.conn().Query(&items, `
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity,
+		       SUM(quantity::bigint) AS total_quantity
+		FROM auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2 AND timestamp >= (
+			SELECT MAX(timestamp) FROM auctions
+			WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2
+		) - ?3
+		GROUP BY item_id, items.name, items.media_url, items.rarity
+		ORDER BY total_quantity DESC
+		LIMIT ?4
+	`, interval, realmId, auctionHouseId, lookback, limit)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+var currentAuctionPriceColumns = []string{"min", "max", "p05", "p10", "p25", "p50", "p75", "p90", "min_buyout"}
+
+// GetCurrentAuctions pages through a house's current auctions. columns
+// restricts the price columns returned to a subset of min, max, p05 through
+// p90 and min_buyout; the others are left zero. With no columns all of them
+// are returned.
+func (database *Database) GetCurrentAuctions(realmId int16, auctionHouseId int16, filter CurrentAuctionFilter, orderBy string, direction string, offset int32, limit int16, columns ...string) (*Page[CurrentAuctionQueryResult], error) {
+	if len(columns) == 0 {
+		columns = currentAuctionPriceColumns
+	}
+	for _, column := range columns {
+		if !slices.Contains(currentAuctionPriceColumns, column) {
+			return nil, fmt.Errorf("invalid price column: %s", column)
+		}
+	}
+
+	orderByQuery := database.currentAuctionsOrderBy(orderBy, direction)
+	whereQuery, params, err := currentAuctionsWhere(realmId, auctionHouseId, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity, 
+		       quantity, %s
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE %s
+		%s
+		OFFSET ? LIMIT ?
+	`, strings.Join(columns, ", "), whereQuery, orderByQuery)
+
+	var currentAuctions []CurrentAuctionQueryResult
+	_, err = database.conn().Query(&currentAuctions, query, append(params, offset, int(limit)+1)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPage(currentAuctions, offset, limit), nil
+}
+
+const currentAuctionQuery = `
+	SELECT realm_id, auction_house_id, item_id, items.name AS item_name, items.media_url AS item_media_url,
+	       items.rarity AS item_rarity, quantity, min, max, p05, p10, p25, p50, p75, p90, min_buyout
+	FROM current_auctions
+	INNER JOIN items ON item_id = items.id
+	WHERE realm_id = $1 AND auction_house_id = $2 AND item_id = $3
+`
+
+// GetCurrentAuction looks up a single item's current auction. Outside a
+// transaction it runs as a prepared statement, so the server doesn't parse
+// and plan the query again on every call.
+func (database *Database) GetCurrentAuction(realmId int16, auctionHouseId int16, itemId int32) (*CurrentAuctionQueryResult, error) {
+	currentAuction := &CurrentAuctionQueryResult{}
+	var err error
+	if database.tx == nil && database.currentAuctionStmts != nil {
+		err = database.currentAuctionStmts.queryOne(currentAuction, realmId, auctionHouseId, itemId)
+	} else {
+		err = database.queryCurrentAuction(currentAuction, realmId, auctionHouseId, itemId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return currentAuction, nil
+}
+
+// queryCurrentAuction is GetCurrentAuction without a prepared statement.
+func (database *Database) queryCurrentAuction(currentAuction *CurrentAuctionQueryResult, realmId int16, auctionHouseId int16, itemId int32) error {
+	_, err := database.conn().QueryOne(currentAuction, positionalQuery(currentAuctionQuery), realmId, auctionHouseId, itemId)
+	return err
+}
+
+// GetCurrentAuctionsMap returns every current auction of a house keyed by
+// item id. Unlike GetCurrentAuctions it is unpaged, so the whole house is held
+// in memory at once; a large house can hold tens of thousands of items at a
+// few hundred bytes each, so prefer the paged listing where that matters.
+func (database *Database) GetCurrentAuctionsMap(realmId int16, auctionHouseId int16) (map[int32]CurrentAuctionQueryResult, error) {
+	var currentAuctions []CurrentAuctionQueryResult
+	_, err := database.conn().Query(&currentAuctions, `
+		SELECT realm_id, auction_house_id, item_id, items.name AS item_name, items.media_url AS item_media_url,
+		       items.rarity AS item_rarity, quantity, min, max, p05, p10, p25, p50, p75, p90, min_buyout
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE realm_id = ? AND auction_house_id = ?
+	`, realmId, auctionHouseId)
+	if err != nil {
+		return nil, err
+	}
+
+	currentAuctionsByItem := make(map[int32]CurrentAuctionQueryResult, len(currentAuctions))
+	for _, currentAuction := range currentAuctions {
+		currentAuctionsByItem[int32(currentAuction.ItemID)] = currentAuction
+	}
+	return currentAuctionsByItem, nil
+}
+
+// EvaluatePriceAlerts returns the alerts whose item currently has a listing
+// below the threshold, checking all of them in one query. Alerts for items
+// that aren't listed are not triggered. The returned alerts keep the order
+// they were given in.
+func (database *Database) EvaluatePriceAlerts(alerts []PriceAlert) ([]PriceAlert, error) {
+	if len(alerts) == 0 {
+		return []PriceAlert{}, nil
+	}
+
+	values := make([]string, len(alerts))
+	params := make([]interface{}, 0, len(alerts)*5)
+	for i, alert := range alerts {
+		values[i] = "(?, ?, ?, ?, ?)"
+		params = append(params, i, alert.RealmID, alert.AuctionHouseID, alert.ItemID, alert.Threshold)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT alerts.ordinal
+		FROM (VALUES %s) AS alerts (ordinal, realm_id, auction_house_id, item_id, threshold)
+		INNER JOIN current_auctions ON current_auctions.realm_id = alerts.realm_id
+			AND current_auctions.auction_house_id = alerts.auction_house_id
+			AND current_auctions.item_id = alerts.item_id
+		WHERE current_auctions.min < alerts.threshold
+		ORDER BY alerts.ordinal
+	`, strings.Join(values, ", "))
+
+	var ordinals []int
+	_, err := database.conn().Query(&ordinals, query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	triggered := make([]PriceAlert, len(ordinals))
+	for i, ordinal := range ordinals {
+		triggered[i] = alerts[ordinal]
+	}
+	return triggered, nil
+}
+
+func (database *Database) GetCurrentAuctionsForGroup(groupId int16, auctionHouseId int16, filter CurrentAuctionFilter, orderBy string, direction string, offset int32, limit int16) ([]CurrentAuctionQueryResult, error) {
+	orderByQuery := database.currentAuctionsOrderBy(orderBy, direction)
+	if orderByQuery != "" {
+		// An item is listed once per realm of the group, so item_id alone
+		// doesn't make the order stable across pages.
+		orderByQuery += ", realm_id ASC"
+	}
+	conditions := []string{"realm_id IN (SELECT realm_id FROM connected_realms WHERE group_id = ?)", "auction_house_id = ?"}
+	whereQuery, params, err := currentAuctionsFilterWhere(conditions, []interface{}{groupId, auctionHouseId}, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT realm_id, auction_house_id, item_id, items.name AS item_name, items.media_url AS item_media_url,
+		       items.rarity AS item_rarity, quantity, min, max, p05, p10, p25, p50, p75, p90, min_buyout
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE %s
+		%s
+		OFFSET ? LIMIT ?
+	`, whereQuery, orderByQuery)
+
+	var currentAuctions []CurrentAuctionQueryResult
+	_, err = database.conn().Query(&currentAuctions, query, append(params, offset, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return currentAuctions, nil
+}
+
+// GetCurrentAuctionsAfter pages through a whole auction house in item_id
+// order. Pass 0 to start and the last ItemID returned to continue; an empty
+// result means the scan is complete.
+func (database *Database) GetCurrentAuctionsAfter(realmId int16, auctionHouseId int16, afterItemId int32, limit int16) ([]CurrentAuctionQueryResult, error) {
+	var currentAuctions []CurrentAuctionQueryResult
+	_, err := database.conn().Query(&currentAuctions, `
+		SELECT realm_id, auction_house_id, item_id, items.name AS item_name, items.media_url AS item_media_url,
+		       items.rarity AS item_rarity, quantity, min, max, p05, p10, p25, p50, p75, p90, min_buyout
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE realm_id = ? AND auction_house_id = ? AND item_id > ?
+		ORDER BY item_id
+		LIMIT ?
+	`, realmId, auctionHouseId, afterItemId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return currentAuctions, nil
+}
+
+func (database *Database) GetAuctionHouseItemPage(realmId int16, auctionHouseId int16, filter CurrentAuctionFilter, orderBy string, direction string, offset int32, limit int16) (*CurrentAuctionPage, error) {
+	orderByQuery := database.currentAuctionsOrderBy(orderBy, direction)
+	whereQuery, params, err := currentAuctionsWhere(realmId, auctionHouseId, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity, 
+		       quantity, min, max, p05, p10, p25, p50, p75, p90, min_buyout, COUNT(*) OVER() AS total_count
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE %s
+		%s
+		OFFSET ? LIMIT ?
+	`, whereQuery, orderByQuery)
+
+	var rows []currentAuctionPageRow
+	_, err = database.conn().Query(&rows, query, append(params, offset, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &CurrentAuctionPage{
+		Items: make([]CurrentAuctionQueryResult, len(rows)),
+	}
+	for i, row := range rows {
+		page.Items[i] = row.CurrentAuctionQueryResult
+		page.Total = row.TotalCount
+	}
+
+	// The window count is only available on returned rows, so a page past the
+	// end has to fall back to a separate count.
+	if len(rows) == 0 && offset > 0 {
+		page.Total, err = database.countCurrentAuctionsWhere(whereQuery, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+func (database *Database) countCurrentAuctionsWhere(whereQuery string, params []interface{}) (int, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE %s
+	`, whereQuery)
+
+	var count int
+	_, err := database.conn().QueryOne(pg.Scan(&count), query, params...)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountCurrentAuctions counts the rows GetCurrentAuctions would list for the
+// same filter, across all pages.
+func (database *Database) CountCurrentAuctions(realmId int16, auctionHouseId int16, filter CurrentAuctionFilter) (int, error) {
+	whereQuery, params, err := currentAuctionsWhere(realmId, auctionHouseId, filter)
+	if err != nil {
+		return 0, err
+	}
+	return database.countCurrentAuctionsWhere(whereQuery, params)
+}
+
+// GetRarityBreakdown counts a house's current listings and their total
+// quantity per item rarity. An empty house yields an empty map.
+func (database *Database) GetRarityBreakdown(realmId int16, auctionHouseId int16) (map[string]RarityBreakdown, error) {
+	var rows []rarityBreakdownRow
+	_, err := database.conn().Query(&rows, `
+		SELECT items.rarity, COUNT(*) AS listings, SUM(quantity) AS quantity
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE realm_id = ? AND auction_house_id = ?
+		GROUP BY items.rarity
+	`, realmId, auctionHouseId)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := make(map[string]RarityBreakdown, len(rows))
+	for _, row := range rows {
+		breakdown[row.Rarity] = RarityBreakdown{Listings: row.Listings, Quantity: row.Quantity}
+	}
+	return breakdown, nil
+}
+
+// GetHouseMedianPrice returns the median of all current p50 prices in a
+// house, rounded to whole copper, or 0 for an empty house.
+func (database *Database) GetHouseMedianPrice(realmId int16, auctionHouseId int16) (int32, error) {
+	var median int32
+	_, err := database.conn().QueryOne(pg.Scan(&median), `
+		SELECT COALESCE(ROUND(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY p50))::int, 0)
+		FROM current_auctions
+		WHERE realm_id = ? AND auction_house_id = ?
+	`, realmId, auctionHouseId)
+	if err != nil {
+		return 0, err
+	}
+	return median, nil
+}
+
+func (database *Database) GetItemsWithActiveAuctionsCount(limit int16) ([]ItemListingCount, error) {
+	var items []ItemListingCount
+	_, err := database.conn().Query(&items, `
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity,
+		       COUNT(DISTINCT (realm_id, auction_house_id)) AS listing_count
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		GROUP BY item_id, items.name, items.media_url, items.rarity
+		ORDER BY listing_count DESC, item_id
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (database *Database) GetAuctionHousesWithItem(itemId int32) ([]RealmAuctionHouse, error) {
+	var realmAuctionHouses []RealmAuctionHouse
+	_, err := database.conn().Query(&realmAuctionHouses, `
+		SELECT DISTINCT realm_id, auction_house_id
+		FROM current_auctions
+		WHERE item_id = ?
+		ORDER BY realm_id, auction_house_id
+	`, itemId)
+	if err != nil {
+		return nil, err
+	}
+	return realmAuctionHouses, nil
+}
+
+func (database *Database) GetItemsSoldBelowVendorPrice(realmId int16, auctionHouseId int16, direction string, offset int32, limit int16) ([]VendorFlipQueryResult, error) {
+	var directionQuery string
+	if direction == "asc" {
+		directionQuery = "ASC"
+	} else {
+		directionQuery = "DESC"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity,
+		       quantity, min, items.sell_price, items.sell_price - min AS profit
+		FROM current_auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE realm_id = ? AND auction_house_id = ? AND items.sell_price > 0 AND min < items.sell_price
+		ORDER BY profit %s
+		OFFSET ? LIMIT ?
+	`, directionQuery)
+
+	var results []VendorFlipQueryResult
+	_, err := database.conn().Query(&results, query, realmId, auctionHouseId, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetCurrentAuctionsGeneration returns a counter that increases every time
+// ReplaceCurrentAuctions brings in data for the realm and auction house, or 0
+// if it never has. Clients can cache listings until the value changes.
+func (database *Database) GetCurrentAuctionsGeneration(realmId int16, auctionHouseId int16) (int64, error) {
+	var generations []int64
+	err := database.conn().Model((*DatasetRefresh)(nil)).
+		Column("generation").
+		Where("realm_id = ? AND auction_house_id = ? AND dataset = 'current_auctions'", realmId, auctionHouseId).
+		Select(&generations)
+	if err != nil {
+		return 0, err
+	}
+	if len(generations) == 0 {
+		return 0, nil
+	}
+	return generations[0], nil
+}
+
+// GetPriceAveragesAge returns how long ago ReplacePriceAverages last brought
+// in averages for the realm and auction house. It returns pg.ErrNoRows if
+// they have never been replaced. The age is measured on the database
+// server's clock, the one refreshed_at was written with, so clock skew on the
+// caller doesn't distort it.
+func (database *Database) GetPriceAveragesAge(realmId int16, auctionHouseId int16) (time.Duration, error) {
+	var microseconds int64
+	_, err := database.conn().QueryOne(pg.Scan(&microseconds), `
+		SELECT (EXTRACT(EPOCH FROM now() - refreshed_at) * 1000000)::bigint
+		FROM dataset_refreshes
+		WHERE realm_id = ? AND auction_house_id = ? AND dataset = 'price_averages'
+	`, realmId, auctionHouseId)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(microseconds) * time.Microsecond, nil
+}
+
+// GetStaleAuctionHouses returns every auction house of an enabled realm whose
+// current auctions were last replaced more than maxAge ago, in the same order
+// as GetRealmAuctionHouseMatrix. Houses that have never been replaced count as
+// stale.
+func (database *Database) GetStaleAuctionHouses(maxAge time.Duration) ([]RealmAuctionHouse, error) {
+	var realmAuctionHouses []RealmAuctionHouse
+	_, err := database.conn().Query(&realmAuctionHouses, `
+		SELECT realms.id AS realm_id, auction_houses.id AS auction_house_id
+		FROM realms
+		CROSS JOIN auction_houses
+		LEFT JOIN dataset_refreshes ON dataset_refreshes.realm_id = realms.id
+			AND dataset_refreshes.auction_house_id = auction_houses.id
+			AND dataset_refreshes.dataset = 'current_auctions'
+		WHERE realms.enabled AND (dataset_refreshes.refreshed_at IS NULL
+			OR dataset_refreshes.refreshed_at < now() - ? * interval '1 second')
+		ORDER BY realms.id, auction_houses.id
+	`, maxAge.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return realmAuctionHouses, nil
+}
+
+// GetRealmAuctionHouseMatrix returns the current auction count and last
+// replace of every auction house on the enabled realms.
+func (database *Database) GetRealmAuctionHouseMatrix() ([]RealmAuctionHouseStatus, error) {
+	var statuses []RealmAuctionHouseStatus
+	_, err := database.conn().Query(&statuses, `
+		SELECT realms.id AS realm_id, auction_houses.id AS auction_house_id,
+		       COALESCE(counts.count, 0) AS current_auction_count, dataset_refreshes.refreshed_at AS last_replaced_at
+		FROM realms
+		CROSS JOIN auction_houses
+		LEFT JOIN (
+			SELECT realm_id, auction_house_id, COUNT(*) AS count
+			FROM current_auctions
+			GROUP BY realm_id, auction_house_id
+		) counts ON counts.realm_id = realms.id AND counts.auction_house_id = auction_houses.id
+		LEFT JOIN dataset_refreshes ON dataset_refreshes.realm_id = realms.id
+			AND dataset_refreshes.auction_house_id = auction_houses.id
+			AND dataset_refreshes.dataset = 'current_auctions'
+		WHERE realms.enabled
+		ORDER BY realms.id, auction_houses.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (database *Database) GetRealmItemAvailability(realmId int16, itemId int32) (*RealmItemAvailability, error) {
+	var auctionHouses []AuctionHouseAvailability
+	_, err := database.conn().Query(&auctionHouses, `
+		SELECT auction_house_id, SUM(quantity::bigint) AS quantity, MIN(min) AS min
+		FROM current_auctions
+		WHERE realm_id = ? AND item_id = ?
+		GROUP BY auction_house_id
+		ORDER BY auction_house_id
+	`, realmId, itemId)
+	if err != nil {
+		return nil, err
+	}
+
+	availability := &RealmItemAvailability{
+		AuctionHouses: auctionHouses,
+	}
+	for i, auctionHouse := range auctionHouses {
+		availability.TotalQuantity += auctionHouse.Quantity
+		if i == 0 || auctionHouse.Min < availability.Min {
+			availability.Min = auctionHouse.Min
+		}
+	}
+	return availability, nil
+}
+
+func (database *Database) GetItemPriceComparison(itemId int32, realmIds []int16) ([]ItemPriceComparison, error) {
+	if len(realmIds) == 0 {
+		return []ItemPriceComparison{}, nil
+	}
+
+	var comparisons []ItemPriceComparison
+	_, err := database.conn().Query(&comparisons, `
+		SELECT realm_id, auction_house_id, quantity, min
+		FROM current_auctions
+		WHERE item_id = ? AND realm_id IN (?)
+		ORDER BY min, realm_id, auction_house_id
+	`, itemId, pg.In(realmIds))
+	if err != nil {
+		return nil, err
+	}
+	return comparisons, nil
+}
+
+// GetCrossHouseArbitrage compares an item between auctionHouseId and
+// oppositeAuctionHouseId on the same realm, typically the two faction houses.
+func (database *Database) GetCrossHouseArbitrage(realmId int16, auctionHouseId int16, oppositeAuctionHouseId int16, itemId int32) (*CrossHouseArbitrage, error) {
+	arbitrage := &CrossHouseArbitrage{}
+	_, err := database.conn().QueryOne(arbitrage, `
+		SELECT COALESCE(house.min, 0) AS min, COALESCE(house.quantity, 0) AS quantity,
+		       house.item_id IS NOT NULL AS listed,
+		       COALESCE(opposite.min, 0) AS opposite_min, COALESCE(opposite.quantity, 0) AS opposite_quantity,
+		       opposite.item_id IS NOT NULL AS opposite_listed
+		FROM (SELECT 1) AS item
+		LEFT JOIN current_auctions AS house
+			ON house.realm_id = ?0 AND house.auction_house_id = ?1 AND house.item_id = ?3
+		LEFT JOIN current_auctions AS opposite
+			ON opposite.realm_id = ?0 AND opposite.auction_house_id = ?2 AND opposite.item_id = ?3
+	`, realmId, auctionHouseId, oppositeAuctionHouseId, itemId)
+	if err != nil {
+		return nil, err
+	}
+
+	if arbitrage.Listed && arbitrage.OppositeListed && arbitrage.Min > 0 {
+		arbitrage.Ratio = float64(arbitrage.OppositeMin) / float64(arbitrage.Min)
+	}
+	return arbitrage, nil
+}
+
+func (database *Database) DeleteCurrentAuctionsForItem(realmId int16, auctionHouseId int16, itemId int32) (int, error) {
+	result, err := database.conn().Model((*CurrentAuction)(nil)).
+		Where("realm_id = ? AND auction_house_id = ? AND item_id = ?", realmId, auctionHouseId, itemId).
+		Delete()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// InsertAuctions inserts new auction snapshots. A row whose key already
+// exists fails the batch; use InsertAuctionsUpsert to overwrite it instead.
+func (database *Database) InsertAuctions(auctions []*Auction) error {
+	start := time.Now()
+	err := insertAuctions(database.db, database.BatchSize, database.ServerTimestamps, "", auctions)
+	if err != nil {
+		return err
+	}
+
+	database.reportBulkInsert("auctions", len(auctions), start)
+	return nil
+}
+
+// auctionsUpsertConflict makes go-pg overwrite every non-key column with the
+// incoming row's value.
+const auctionsUpsertConflict = "(realm_id, auction_house_id, item_id, interval, timestamp) DO UPDATE"
+
+// InsertAuctionsUpsert is InsertAuctions for corrected snapshots: when a row
+// for the same realm, house, item, interval and timestamp already exists, its
+// quantity and percentiles are replaced by the new values. Re-sending the same
+// correction is harmless.
+func (database *Database) InsertAuctionsUpsert(auctions []*Auction) error {
+	start := time.Now()
+	err := insertAuctions(database.db, database.BatchSize, database.ServerTimestamps, auctionsUpsertConflict, auctions)
+	if err != nil {
+		return err
+	}
+
+	database.reportBulkInsert("auctions", len(auctions), start)
+	return nil
+}
+
+func insertAuctions(db orm.DB, batchSize int, serverTimestamps bool, onConflict string, auctions []*Auction) error {
+	if serverTimestamps {
+		err := assignServerTimestamps(db, auctions)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(auctions); i += batchSize {
+		end := i + batchSize
+		if end > len(auctions) {
+			end = len(auctions)
+		}
+		batch := auctions[i:end]
+		query := db.Model(&batch)
+		if onConflict != "" {
+			query = query.OnConflict(onConflict)
+		}
+		_, err := query.Insert()
+		if err != nil {
+			return &BatchInsertError{
+				RowsInserted:    i,
+				BatchesInserted: i / batchSize,
+				Err:             err,
+			}
+		}
+	}
+
+	return nil
+}
+
+func buyoutBounds(conditions []string, params []interface{}, minBuyout int32, maxBuyout int32) ([]string, []interface{}) {
+	if minBuyout > 0 {
+		conditions = append(conditions, "buyout_each >= ?")
+		params = append(params, minBuyout)
+	}
+	if maxBuyout > 0 {
+		conditions = append(conditions, "buyout_each <= ?")
+		params = append(params, maxBuyout)
+	}
+	return conditions, params
+}
+
+// assignServerTimestamps stamps auctions that have no timestamp with the
+// database server's current epoch, so rows from different workers agree on
+// time regardless of their local clocks.
+func assignServerTimestamps(db orm.DB, auctions []*Auction) error {
+	var now int32
+	for _, auction := range auctions {
+		if auction.Timestamp != 0 {
+			continue
+		}
+		if now == 0 {
+			_, err := db.QueryOne(pg.Scan(&now), "SELECT extract(epoch from now())::int")
+			if err != nil {
+				return err
+			}
+		}
+		auction.Timestamp = now
+	}
+	return nil
+}
+
+func (database *Database) GetPriceDistributions(realmId int16, auctionHouseId int16, itemId int32, minBuyout int32, maxBuyout int32) ([]PriceDistribution, error) {
+	conditions, params := buyoutBounds(
+		[]string{"realm_id = ?", "auction_house_id = ?", "item_id = ?"},
+		[]interface{}{realmId, auctionHouseId, itemId},
+		minBuyout, maxBuyout)
+
+	query := fmt.Sprintf(`
+		SELECT buyout_each, quantity
+		FROM price_distributions
+		WHERE %s ORDER BY buyout_each
+	`, strings.Join(conditions, " AND "))
+
+	var priceDistributions []PriceDistribution
+	_, err := database.conn().Query(&priceDistributions, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return priceDistributions, nil
+}
+
+// ForEachPriceDistribution streams every price distribution of an auction
+// house, calling fn once per item with that item's rows ordered by
+// buyout_each. Only one item's rows are held in memory at a time. An error
+// returned by fn stops the iteration and is returned as is.
+func (database *Database) ForEachPriceDistribution(realmId int16, auctionHouseId int16, fn func(itemId int32, priceDistributions []PriceDistribution) error) error {
+	var itemId int32
+	var group []PriceDistribution
+
+	err := database.conn().Model((*PriceDistribution)(nil)).
+		Where("realm_id = ?", realmId).
+		Where("auction_house_id = ?", auctionHouseId).
+		Order("item_id", "buyout_each").
+		ForEach(func(priceDistribution *PriceDistribution) error {
+			if len(group) > 0 && priceDistribution.ItemID != itemId {
+				if err := fn(itemId, group); err != nil {
+					return err
+				}
+				group = nil
+			}
+			itemId = priceDistribution.ItemID
+			group = append(group, *priceDistribution)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if len(group) > 0 {
+		return fn(itemId, group)
+	}
+	return nil
+}
+
+// GetNormalizedPriceDistributions is GetPriceDistributions with each bucket's
+// share of the item's total quantity as a percentage. Shares are relative to
+// the whole distribution, so they don't change when buyout bounds are set.
+func (database *Database) GetNormalizedPriceDistributions(realmId int16, auctionHouseId int16, itemId int32, minBuyout int32, maxBuyout int32) ([]NormalizedPriceDistribution, error) {
+	conditions, params := buyoutBounds(
+		[]string{"TRUE"},
+		[]interface{}{realmId, auctionHouseId, itemId},
+		minBuyout, maxBuyout)
+
+	query := fmt.Sprintf(`
+		SELECT buyout_each, quantity, share
+		FROM (
+			SELECT buyout_each, quantity, quantity * 100.0 / SUM(quantity) OVER () AS share
+			FROM price_distributions
+			WHERE realm_id = ? AND auction_house_id = ? AND item_id = ?
+		) AS distribution
+		WHERE %s ORDER BY buyout_each
+	`, strings.Join(conditions, " AND "))
+
+	var priceDistributions []NormalizedPriceDistribution
+	_, err := database.conn().Query(&priceDistributions, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return priceDistributions, nil
+}
+
+func (database *Database) GetCumulativePriceDistributions(realmId int16, auctionHouseId int16, itemId int32) ([]CumulativePriceDistribution, error) {
+	var priceDistributions []CumulativePriceDistribution
+	_, err := database.conn().Query(&priceDistributions, `
+		SELECT buyout_each, quantity, SUM(quantity::bigint) OVER (ORDER BY buyout_each) AS cumulative_quantity
+		FROM price_distributions
+		WHERE realm_id = ? AND auction_house_id = ? AND item_id = ?
+		ORDER BY buyout_each
+	`, realmId, auctionHouseId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	return priceDistributions, nil
+}
+
+// GetAveragedPriceDistributions reduces an item's distribution to at most
+// buckets equal-width price ranges between its lowest and highest buyout.
+// Empty ranges are omitted.
+func (database *Database) GetAveragedPriceDistributions(realmId int16, auctionHouseId int16, itemId int32, buckets int16) ([]AveragedPriceDistribution, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("buckets must be positive: %d", buckets)
+	}
+
+	var priceDistributions []AveragedPriceDistribution
+	_, err := database.conn().Query(&priceDistributions, `
+		WITH bounds AS (
+			SELECT MIN(buyout_each) AS low, MAX(buyout_each) + 1 AS high
+			FROM price_distributions
+			WHERE realm_id = ?0 AND auction_house_id = ?1 AND item_id = ?2
+		)
+		SELECT SUM(buyout_each::float8 * quantity) / SUM(quantity) AS buyout_each,
+		       SUM(quantity) AS quantity
+		FROM price_distributions, bounds
+		WHERE realm_id = ?0 AND auction_house_id = ?1 AND item_id = ?2
+		GROUP BY width_bucket(buyout_each, low, high, ?3)
+		ORDER BY buyout_each
+	`, realmId, auctionHouseId, itemId, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return priceDistributions, nil
+}
+
+// GetPriceDistributionPercentile returns the buyout at percentile (0 to 1) of
+// an item's listed units, interpolated between neighbouring units like
+// PERCENTILE_CONT over one row per unit. The units are located through a
+// running total of quantity, so large stacks don't expand into one row per
+// unit. An item without a distribution returns pg.ErrNoRows.
+func (database *Database) GetPriceDistributionPercentile(realmId int16, auctionHouseId int16, itemId int32, percentile float64) (float64, error) {
+	if percentile < 0 || percentile > 1 {
+		return 0, fmt.Errorf("percentile must be between 0 and 1: %f", percentile)
+	}
+
+	// unit is the 0-based, possibly fractional, index of the percentile among
+	// the units. The unit at index k lies in the first bucket whose running
+	// total exceeds k.
+	var buyout float64
+	_, err := database.conn().QueryOne(pg.Scan(&buyout), `
+		WITH distribution AS (
+			SELECT buyout_each, SUM(quantity) OVER (ORDER BY buyout_each) AS cumulative
+			FROM price_distributions
+			WHERE realm_id = ? AND auction_house_id = ? AND item_id = ? AND quantity > 0
+		), target AS (
+			SELECT ?::float8 * (MAX(cumulative) - 1) AS unit
+			FROM distribution
+		)
+		SELECT (lower.buyout_each + (unit - floor(unit)) * (upper.buyout_each - lower.buyout_each))::float8
+		FROM target
+		CROSS JOIN LATERAL (
+			SELECT buyout_each FROM distribution WHERE cumulative > floor(unit) ORDER BY buyout_each LIMIT 1
+		) AS lower
+		CROSS JOIN LATERAL (
+			SELECT buyout_each FROM distribution WHERE cumulative > ceil(unit) ORDER BY buyout_each LIMIT 1
+		) AS upper
+	`, realmId, auctionHouseId, itemId, percentile)
+	if err != nil {
+		return 0, err
+	}
+	return buyout, nil
+}
+
+const priceAverageSelectColumns = `item_id, quantity_current, quantity_average, quantity_percent, p05_current, p05_average, p05_percent, 
+		       p10_current, p10_average, p10_percent, p25_current, p25_average, p25_percent, p50_current, p50_average, 
+		       p50_percent, p75_current, p75_average, p75_percent, p90_current, p90_average, p90_percent, sample_count`
+
+// GetPriceAverages pages through a house's price averages. A positive
+// minSampleCount leaves out items whose averages come from fewer snapshots,
+// as their percentages are too noisy to be meaningful.
+func (database *Database) GetPriceAverages(realmId int16, auctionHouseId int16, minSampleCount int32, orderBy string, sortBy string, offset int32, limit int16) (*Page[PriceAverage], error) {
+	var orderByQuery string
+	if orderBy == "quantity_percent" {
+		orderByQuery = "quantity_percent"
+	} else {
+		orderByQuery = "p05_percent"
+	}
+
+	var directionQuery string
+	if sortBy == "high" {
+		directionQuery = "DESC"
+	} else {
+		directionQuery = "ASC"
+	}
+
+	conditions := []string{"realm_id = ?", "auction_house_id = ?"}
+	params := []interface{}{realmId, auctionHouseId}
+	if minSampleCount > 0 {
+		conditions = append(conditions, "sample_count >= ?")
+		params = append(params, minSampleCount)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM price_averages
+		WHERE %s
+		ORDER BY %s %s
+		OFFSET ? LIMIT ?
+	`, priceAverageSelectColumns, strings.Join(conditions, " AND "), orderByQuery, directionQuery)
+
+	var priceAverages []PriceAverage
+	_, err := database.conn().Query(&priceAverages, query, append(params, offset, int(limit)+1)...)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(priceAverages, offset, limit), nil
+}
+
+// GetPriceAveragesForItems returns the price averages of the given items with
+// their item details, ordered by item id. Items without price averages are
+// left out.
+func (database *Database) GetPriceAveragesForItems(realmId int16, auctionHouseId int16, itemIds []int32) ([]PriceAverageWithItem, error) {
+	if len(itemIds) == 0 {
+		return []PriceAverageWithItem{}, nil
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity
+		FROM price_averages
+		INNER JOIN items ON item_id = items.id
+		WHERE realm_id = ? AND auction_house_id = ? AND item_id IN (?)
+		ORDER BY item_id
+	`, priceAverageSelectColumns)
+
+	var priceAverages []PriceAverageWithItem
+	_, err := database.conn().Query(&priceAverages, query, realmId, auctionHouseId, pg.In(itemIds))
+	if err != nil {
+		return nil, err
+	}
+	return priceAverages, nil
+}
+
+// GetStablePriceAverages returns items whose p50 stayed within threshold
+// percent of its average, skipping items with fewer than minQuantity listed.
+// The most stable items come first.
+func (database *Database) GetStablePriceAverages(realmId int16, auctionHouseId int16, threshold float32, minQuantity int32, offset int32, limit int16) (*Page[PriceAverage], error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM price_averages
+		WHERE realm_id = ? AND auction_house_id = ? AND ABS(p50_percent) <= ? AND quantity_current >= ?
+		ORDER BY ABS(p50_percent), item_id
+		OFFSET ? LIMIT ?
+	`, priceAverageSelectColumns)
+
+	var priceAverages []PriceAverage
+	_, err := database.conn().Query(&priceAverages, query, realmId, auctionHouseId, threshold, minQuantity, offset, int(limit)+1)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(priceAverages, offset, limit), nil
+}
+
+var priceAverageColumns = []string{"quantity", "p05", "p10", "p25", "p50", "p75", "p90"}
+
+func (database *Database) ComputePriceAverages(interval Interval, realmId int16, auctionHouseId int16, lookback int32) ([]*PriceAverage, error) {
+	var sampleColumns, averageColumns, selectColumns []string
+	for _, column := range priceAverageColumns {
+		if column == "quantity" {
+			sampleColumns = append(sampleColumns, column)
+		} else {
+			sampleColumns = append(sampleColumns, database.priceColumn(column))
+		}
+		averageColumns = append(averageColumns, fmt.Sprintf("AVG(%[1]s) AS %[1]s", column))
+		selectColumns = append(selectColumns, fmt.Sprintf(`
+			latest.%[1]s AS %[1]s_current,
+			ROUND(averages.%[1]s)::int AS %[1]s_average,
+			COALESCE((latest.%[1]s - averages.%[1]s) / NULLIF(averages.%[1]s, 0) * 100, 0) AS %[1]s_percent`, column))
+	}
+
+	query := fmt.Sprintf(`
+		WITH samples AS (
+			SELECT item_id, timestamp, %s
+			FROM auctions
+			WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2 AND timestamp >= (
+				SELECT MAX(timestamp) FROM auctions
+				WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2
+			) - ?3
+		), latest AS (
+			SELECT DISTINCT ON (item_id) *
+			FROM samples
+			ORDER BY item_id, timestamp DESC
+		), averages AS (
+			SELECT item_id, COUNT(*) AS sample_count, %s
+			FROM samples
+			GROUP BY item_id
+		)
+		SELECT ?1 AS realm_id, ?2 AS auction_house_id, latest.item_id, averages.sample_count, %s
+		FROM latest
+		INNER JOIN averages ON averages.item_id = latest.item_id
+	`, strings.Join(sampleColumns, ", "), strings.Join(averageColumns, ", "), strings.Join(selectColumns, ","))
+
+	var priceAverages []*PriceAverage
+	_, err := database.conn().Query(&priceAverages, query, interval, realmId, auctionHouseId, lookback)
+	if err != nil {
+		return nil, err
+	}
+	return priceAverages, nil
+}
+
+// GetItemVolatility returns the standard deviation of an item's p50 over the
+// lookback seconds up to its latest snapshot. Fewer than two snapshots give 0.
+func (database *Database) GetItemVolatility(interval Interval, realmId int16, auctionHouseId int16, itemId int32, lookback int32) (float64, error) {
+	var volatility float64
+	_, err := database.conn().QueryOne(pg.Scan(&volatility), `
+		SELECT COALESCE(STDDEV_SAMP(p50), 0)
+		FROM auctions
+		WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2 AND item_id = ?3 AND timestamp >= (
+			SELECT MAX(timestamp) FROM auctions
+			WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2 AND item_id = ?3
+		) - ?4
+	`, interval, realmId, auctionHouseId, itemId, lookback)
+	if err != nil {
+		return 0, err
+	}
+	return volatility, nil
+}
+
+// GetItemVolatilities is GetItemVolatility for a whole house in one grouped
+// query, over the lookback seconds up to the house's latest snapshot. Items
+// are ranked by volatility, most volatile first for direction "desc", and
+// only items with at least two snapshots in the window are included.
+func (database *Database) GetItemVolatilities(interval Interval, realmId int16, auctionHouseId int16, lookback int32, direction string, limit int16) ([]ItemVolatility, error) {
+	var directionQuery string
+	if direction == "desc" {
+		directionQuery = "DESC"
+	} else {
+		directionQuery = "ASC"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT item_id, items.name AS item_name, items.media_url AS item_media_url, items.rarity AS item_rarity,
+		       STDDEV_SAMP(p50) AS volatility,
+		       COALESCE(
+		           ((array_agg(p50 ORDER BY timestamp DESC))[1] - (array_agg(p50 ORDER BY timestamp))[1])::float8
+		           / NULLIF((array_agg(p50 ORDER BY timestamp))[1], 0) * 100,
+		           0
+		       ) AS percent_change
+		FROM auctions
+		INNER JOIN items ON item_id = items.id
+		WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2 AND timestamp >= (
+			SELECT MAX(timestamp) FROM auctions
+			WHERE interval = ?0 AND realm_id = ?1 AND auction_house_id = ?2
+		) - ?3
+		GROUP BY item_id, items.name, items.media_url, items.rarity
+		HAVING COUNT(*) > 1
+		ORDER BY volatility %s, item_id
+		LIMIT ?4
+	`, directionQuery)
+
+	var volatilities []ItemVolatility
+	_, err := database.conn().Query(&volatilities, query, interval, realmId, auctionHouseId, lookback, limit)
+	if err != nil {
+		return nil, err
+	}
+	return volatilities, nil
+}
+
+func (database *Database) PurgeRealmData(realmId int16) (map[string]int, error) {
+	deleted := make(map[string]int)
+	err := database.db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		for _, table := range []string{"current_auctions", "price_distributions", "price_averages", "dataset_refreshes"} {
+			result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE realm_id = ?", table), realmId)
+			if err != nil {
+				return err
+			}
+			deleted[table] = result.RowsAffected()
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return deleted, nil
+}
 
-	for i := 0; i < len(priceDistributionsTemp); i += database.BatchSize {
-		end := i + database.BatchSize
-		if end > len(priceDistributions) {
-			end = len(priceDistributions)
+var monitoredTables = []string{"auctions", "current_auctions", "items", "price_distributions", "price_averages"}
+
+type tableRowCount struct {
+	TableName string `pg:"table_name"`
+	RowCount  int64  `pg:"row_count"`
+}
+
+// GetTableStats returns row counts for the package's main tables. By default
+// the counts are the planner's estimates from pg_class, which are cheap but
+// only as fresh as the last ANALYZE; exact runs COUNT(*) on every table.
+func (database *Database) GetTableStats(exact bool) (map[string]int64, error) {
+	stats := make(map[string]int64, len(monitoredTables))
+
+	if exact {
+		for _, table := range monitoredTables {
+			var count int64
+			_, err := database.conn().QueryOne(pg.Scan(&count), fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+			if err != nil {
+				return nil, err
+			}
+			stats[table] = count
 		}
-		batch := priceDistributionsTemp[i:end]
-		_, err := database.db.Model(&batch).Insert()
+		return stats, nil
+	}
+
+	var rowCounts []tableRowCount
+	_, err := database.conn().Query(&rowCounts, `
+		SELECT tables.name AS table_name, GREATEST(pg_class.reltuples, 0)::bigint AS row_count
+		FROM unnest(?::text[]) AS tables(name)
+		INNER JOIN pg_class ON pg_class.oid = to_regclass(tables.name)
+	`, pg.Array(monitoredTables))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rowCount := range rowCounts {
+		stats[rowCount.TableName] = rowCount.RowCount
+	}
+	return stats, nil
+}
+
+type ConstraintViolation struct {
+	Table       string `pg:"table_name"`
+	Key         string `pg:"key"`
+	Description string `pg:"description"`
+}
+
+// CheckConstraints looks for data that breaks the package's invariants:
+// current auctions for unknown items, negative quantities and percentiles out
+// of order. It only reads, so it is safe to run against production.
+func (database *Database) CheckConstraints() ([]ConstraintViolation, error) {
+	var violations []ConstraintViolation
+	_, err := database.conn().Query(&violations, `
+		SELECT 'current_auctions' AS table_name,
+		       format('realm_id=%s auction_house_id=%s item_id=%s', realm_id, auction_house_id, item_id) AS key,
+		       'item does not exist' AS description
+		FROM current_auctions
+		WHERE NOT EXISTS (SELECT 1 FROM items WHERE items.id = current_auctions.item_id)
+		UNION ALL
+		SELECT 'current_auctions',
+		       format('realm_id=%s auction_house_id=%s item_id=%s', realm_id, auction_house_id, item_id),
+		       'negative quantity'
+		FROM current_auctions
+		WHERE quantity < 0
+		UNION ALL
+		SELECT 'current_auctions',
+		       format('realm_id=%s auction_house_id=%s item_id=%s', realm_id, auction_house_id, item_id),
+		       'percentiles out of order'
+		FROM current_auctions
+		WHERE NOT (min <= p05 AND p05 <= p10 AND p10 <= p25 AND p25 <= p50 AND p50 <= p75 AND p75 <= p90 AND p90 <= max)
+		UNION ALL
+		SELECT 'price_distributions',
+		       format('realm_id=%s auction_house_id=%s item_id=%s buyout_each=%s', realm_id, auction_house_id, item_id, buyout_each),
+		       'negative quantity'
+		FROM price_distributions
+		WHERE quantity < 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+// recordRefresh bumps the refresh of every realm and auction house in the
+// swapped-in dataset or in the contents it replaced, still in <dataset>_temp
+// while afterSwap runs, so houses whose rows all disappeared are bumped too.
+func recordRefresh(tx *pg.Tx, dataset string) error {
+	_, err := tx.Exec(fmt.Sprintf(`
+		INSERT INTO dataset_refreshes (realm_id, auction_house_id, dataset, refreshed_at, generation)
+		SELECT realm_id, auction_house_id, ?, now(), 1
+		FROM (
+			SELECT realm_id, auction_house_id FROM %[1]s
+			UNION
+			SELECT realm_id, auction_house_id FROM %[1]s_temp
+		) AS houses
+		ON CONFLICT (realm_id, auction_house_id, dataset) DO UPDATE
+			SET refreshed_at = EXCLUDED.refreshed_at, generation = dataset_refreshes.generation + 1
+	`, dataset), dataset)
+	return err
+}
+
+// GetPriceAveragesAgainstBaseline compares each item's current auction values
+// with its auctions row at the baseline timestamp. The result has the
+// PriceAverage shape with the *Average fields holding the baseline values.
+// Items missing from either side are left out.
+func (database *Database) GetPriceAveragesAgainstBaseline(interval Interval, realmId int16, auctionHouseId int16, baseline int32) ([]PriceAverage, error) {
+	var selectColumns []string
+	for _, column := range priceAverageColumns {
+		selectColumns = append(selectColumns, fmt.Sprintf(`
+			current_auctions.%[1]s AS %[1]s_current,
+			baseline.%[1]s AS %[1]s_average,
+			COALESCE((current_auctions.%[1]s::numeric - baseline.%[1]s) / NULLIF(baseline.%[1]s, 0) * 100, 0) AS %[1]s_percent`, column))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT current_auctions.realm_id, current_auctions.auction_house_id, current_auctions.item_id, %s
+		FROM current_auctions
+		INNER JOIN auctions AS baseline ON baseline.realm_id = current_auctions.realm_id
+			AND baseline.auction_house_id = current_auctions.auction_house_id
+			AND baseline.item_id = current_auctions.item_id
+			AND baseline.interval = ? AND baseline.timestamp = ?
+		WHERE current_auctions.realm_id = ? AND current_auctions.auction_house_id = ?
+		ORDER BY current_auctions.item_id
+	`, strings.Join(selectColumns, ","))
+
+	var priceAverages []PriceAverage
+	_, err := database.conn().Query(&priceAverages, query, interval, baseline, realmId, auctionHouseId)
+	if err != nil {
+		return nil, err
+	}
+	return priceAverages, nil
+}
+
+// RefreshPriceAverages rebuilds price_averages when it is deployed as a
+// materialized view instead of a table fed by ReplacePriceAverages. The
+// refresh runs concurrently, so readers keep seeing the previous contents
+// until it finishes.
+func (database *Database) RefreshPriceAverages() error {
+	return database.db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		err := database.liftStatementTimeout(tx)
 		if err != nil {
 			return err
 		}
+		_, err = tx.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY price_averages")
+		return err
+	})
+}
+
+// lockReplace takes a session advisory lock for each table on a dedicated
+// connection, failing with ErrReplaceInProgress if any is held elsewhere. The
+// returned func releases the locks and the connection.
+//
+// Together with each load truncating its temp table first, this makes the
+// Replace* methods safe to retry: a call that returned an error either never
+// swapped, leaving the live table untouched, or had already committed, in
+// which case the retry swaps in the same rows again. A retry issued while
+// the first attempt is still running, for example after a client-side
+// timeout, gets ErrReplaceInProgress and should be retried later.
+func (database *Database) lockReplace(tables ...string) (func(), error) {
+	conn := database.db.Conn()
+	for _, table := range tables {
+		var acquired bool
+		_, err := conn.QueryOne(pg.Scan(&acquired), "SELECT pg_try_advisory_lock(hashtext('replace'), hashtext(?))", table)
+		if err == nil && !acquired {
+			err = ErrReplaceInProgress
+		}
+		if err != nil {
+			conn.Exec("SELECT pg_advisory_unlock_all()")
+			conn.Close()
+			return nil, err
+		}
 	}
 
+	return func() {
+		conn.Exec("SELECT pg_advisory_unlock_all()")
+		conn.Close()
+	}, nil
+}
+
+// swapTable promotes <table>_temp to <table> inside a single transaction and
+// leaves the previous contents truncated in <table>_temp for the next load.
+// afterSwap, when set, runs inside the same transaction after the renames and
+// before <table>_temp is truncated, so it can still read the previous contents.
+func (database *Database) swapTable(table string, afterSwap func(tx *pg.Tx) error) error {
+	return database.swapTables([]string{table}, afterSwap)
+}
+
+// swapTables is swapTable for several tables at once, all within the same
+// transaction. Replace events are reported for each table.
+func (database *Database) swapTables(tables []string, afterSwap func(tx *pg.Tx) error) error {
+	database.logReplaces(tables, "started", "", nil)
+
 	tx, err := database.db.Begin()
 	if err != nil {
-		tx.Rollback()
+		database.logReplaces(tables, "rolled_back", "begin", err)
 		return err
 	}
 
-	_, err = tx.Exec("ALTER TABLE price_distributions RENAME TO price_distributions_temp2")
+	err = database.liftStatementTimeout(tx)
 	if err != nil {
 		tx.Rollback()
+		database.logReplaces(tables, "rolled_back", "statement timeout", err)
 		return err
 	}
 
-	_, err = tx.Exec("ALTER TABLE price_distributions_temp RENAME TO price_distributions")
+	var steps []string
+	for _, table := range tables {
+		steps = append(steps,
+			fmt.Sprintf("ALTER TABLE %[1]s RENAME TO %[1]s_temp2", table),
+			fmt.Sprintf("ALTER TABLE %[1]s_temp RENAME TO %[1]s", table),
+			fmt.Sprintf("ALTER TABLE %[1]s_temp2 RENAME TO %[1]s_temp", table),
+		)
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			tx.Rollback()
+			database.logReplaces(tables, "rolled_back", step, err)
+			return err
+		}
+	}
+
+	if afterSwap != nil {
+		err = afterSwap(tx)
+		if err != nil {
+			tx.Rollback()
+			database.logReplaces(tables, "rolled_back", "after swap", err)
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		step := fmt.Sprintf("TRUNCATE TABLE %s_temp", table)
+		_, err = tx.Exec(step)
+		if err != nil {
+			tx.Rollback()
+			database.logReplaces(tables, "rolled_back", step, err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
+		database.logReplaces(tables, "rolled_back", "commit", err)
 		return err
 	}
 
-	_, err = tx.Exec("ALTER TABLE price_distributions_temp2 RENAME TO price_distributions_temp")
+	database.logReplaces(tables, "committed", "", nil)
+	return nil
+}
+
+func (database *Database) logReplaces(tables []string, stage string, step string, err error) {
+	for _, table := range tables {
+		database.logReplace(table, stage, step, err)
+	}
+}
+
+func (database *Database) logReplace(table string, stage string, step string, err error) {
+	if database.OnReplace == nil {
+		return
+	}
+	database.OnReplace(ReplaceEvent{
+		Table: table,
+		Stage: stage,
+		Step:  step,
+		Time:  time.Now(),
+		Err:   err,
+	})
+}
+
+func (database *Database) ReplacePriceDistributions(priceDistributions []*PriceDistribution) error {
+	if len(priceDistributions) == 0 && !database.AllowEmptyReplace {
+		return ErrEmptyReplace
+	}
+
+	unlock, err := database.lockReplace("price_distributions")
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	defer unlock()
 
-	_, err = tx.Exec("TRUNCATE TABLE price_distributions_temp")
+	start := time.Now()
+	err = database.loadPriceDistributionsTemp(priceDistributions)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	err = tx.Commit()
+	err = database.swapTable("price_distributions", func(tx *pg.Tx) error {
+		return fillMinBuyouts(tx, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	database.reportBulkInsert("price_distributions", len(priceDistributions), start)
+	return nil
+}
+
+func (database *Database) loadPriceDistributionsTemp(priceDistributions []*PriceDistribution) error {
+	// Clears rows left behind by an earlier attempt that failed mid-load.
+	_, err := database.conn().Exec("TRUNCATE TABLE price_distributions_temp")
+	if err != nil {
+		return err
+	}
+
+	priceDistributionsTemp := make([]*priceDistributionTemp, len(priceDistributions))
+	for i, v := range priceDistributions {
+		priceDistributionsTemp[i] = &priceDistributionTemp{
+			RealmID:        v.RealmID,
+			AuctionHouseID: v.AuctionHouseID,
+			ItemID:         v.ItemID,
+			BuyoutEach:     v.BuyoutEach,
+			Quantity:       v.Quantity,
+		}
+	}
+
+	for i := 0; i < len(priceDistributionsTemp); i += database.BatchSize {
+		end := i + database.BatchSize
+		if end > len(priceDistributions) {
+			end = len(priceDistributions)
+		}
+		batch := priceDistributionsTemp[i:end]
+		_, err := database.conn().Model(&batch).Insert()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplacePriceDistributionsForAuctionHouse replaces the distributions of a
+// single realm and auction house, leaving every other house untouched. The
+// delete and insert share one transaction, and concurrent replaces of the
+// same house are serialized with an advisory lock. It fails with
+// ErrReplaceInProgress while a full replace of price_distributions is
+// running, and the other way round. The house's min_buyout in
+// current_auctions is refilled in the same transaction.
+func (database *Database) ReplacePriceDistributionsForAuctionHouse(realmId int16, auctionHouseId int16, priceDistributions []*PriceDistribution) error {
+	if len(priceDistributions) == 0 && !database.AllowEmptyReplace {
+		return ErrEmptyReplace
+	}
+	for _, v := range priceDistributions {
+		if v.RealmID != realmId || v.AuctionHouseID != auctionHouseId {
+			return fmt.Errorf("price distribution for realm %d auction house %d does not belong to realm %d auction house %d",
+				v.RealmID, v.AuctionHouseID, realmId, auctionHouseId)
+		}
+	}
+
+	start := time.Now()
+	err := database.db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		err := database.liftStatementTimeout(tx)
+		if err != nil {
+			return err
+		}
+
+		// A shared hold on the table's replace lock lets replaces of different
+		// houses run together while keeping out a full replace, whose swap
+		// would otherwise discard this house's new rows.
+		var acquired bool
+		_, err = tx.QueryOne(pg.Scan(&acquired), "SELECT pg_try_advisory_xact_lock_shared(hashtext('replace'), hashtext('price_distributions'))")
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return ErrReplaceInProgress
+		}
+
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('price_distributions'), ?)", int32(realmId)<<16|int32(auctionHouseId))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Model((*PriceDistribution)(nil)).
+			Where("realm_id = ? AND auction_house_id = ?", realmId, auctionHouseId).
+			Delete()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(priceDistributions); i += database.BatchSize {
+			end := i + database.BatchSize
+			if end > len(priceDistributions) {
+				end = len(priceDistributions)
+			}
+			batch := priceDistributions[i:end]
+			_, err := tx.Model(&batch).Insert()
+			if err != nil {
+				return err
+			}
+		}
+
+		return fillMinBuyouts(tx, "WHERE realm_id = ? AND auction_house_id = ?", realmId, auctionHouseId)
+	})
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
+	database.reportBulkInsert("price_distributions", len(priceDistributions), start)
 	return nil
 }
 
 func (database *Database) ReplaceCurrentAuctions(auctions []*Auction) error {
+	return database.replaceCurrentAuctions(auctions, database.currentAuctionsLoader())
+}
+
+// replaceCurrentAuctions is ReplaceCurrentAuctions with the loader of
+// current_auctions_temp passed in, so the benchmarks can compare loaders.
+func (database *Database) replaceCurrentAuctions(auctions []*Auction, load func(db orm.DB, auctions []*Auction) error) error {
+	if len(auctions) == 0 && !database.AllowEmptyReplace {
+		return ErrEmptyReplace
+	}
+
+	unlock, err := database.lockReplace("current_auctions")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	start := time.Now()
+	err = database.loadCurrentAuctionsTemp(auctions, load)
+	if err != nil {
+		return err
+	}
+
+	err = database.swapTable("current_auctions", func(tx *pg.Tx) error {
+		err := fillMinBuyouts(tx, "")
+		if err != nil {
+			return err
+		}
+		return recordRefresh(tx, "current_auctions")
+	})
+	if err != nil {
+		return err
+	}
+
+	database.reportCurrentAuctionsLoad(len(auctions), start)
+	return nil
+}
+
+func (database *Database) currentAuctionsLoader() func(db orm.DB, auctions []*Auction) error {
+	if database.CopyCurrentAuctions {
+		return copyCurrentAuctions
+	}
+	return database.insertCurrentAuctions
+}
+
+// reportCurrentAuctionsLoad reports a current_auctions load, which is a single
+// batch when it went through COPY.
+func (database *Database) reportCurrentAuctionsLoad(rows int, start time.Time) {
+	if database.CopyCurrentAuctions {
+		database.reportBulkInsertBatches("current_auctions", rows, 1, start)
+		return
+	}
+	database.reportBulkInsert("current_auctions", rows, start)
+}
+
+// loadCurrentAuctionsTemp loads auctions into current_auctions_temp with load.
+func (database *Database) loadCurrentAuctionsTemp(auctions []*Auction, load func(db orm.DB, auctions []*Auction) error) error {
+	return database.db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		err := database.liftStatementTimeout(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("TRUNCATE TABLE current_auctions_temp")
+		if err != nil {
+			return err
+		}
+		return load(tx, auctions)
+	})
+}
+
+// fillMinBuyouts sets min_buyout on the current auctions matching where to the
+// lowest buyout in price_distributions, or NULL when the item has none. The
+// Replace* methods call it in the transaction that changes either table, so
+// the two never disagree once it commits.
+func fillMinBuyouts(tx *pg.Tx, where string, params ...interface{}) error {
+	_, err := tx.Exec(fmt.Sprintf(`
+		UPDATE current_auctions
+		SET min_buyout = (
+			SELECT MIN(buyout_each)
+			FROM price_distributions
+			WHERE price_distributions.realm_id = current_auctions.realm_id
+				AND price_distributions.auction_house_id = current_auctions.auction_house_id
+				AND price_distributions.item_id = current_auctions.item_id
+		)
+		%s
+	`, where), params...)
+	return err
+}
+
+// insertCurrentAuctions loads auctions into current_auctions_temp in
+// BatchSize INSERTs.
+func (database *Database) insertCurrentAuctions(db orm.DB, auctions []*Auction) error {
 	currentAuctions := make([]*currentAuctionsTemp, len(auctions))
 	for i, v := range auctions {
 		currentAuctions[i] = &currentAuctionsTemp{
@@ -463,52 +3540,85 @@ func (database *Database) ReplaceCurrentAuctions(auctions []*Auction) error {
 			end = len(currentAuctions)
 		}
 		batch := currentAuctions[i:end]
-		_, err := database.db.Model(&batch).Insert()
+		_, err := db.Model(&batch).Insert()
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	tx, err := database.db.Begin()
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
+// copyCurrentAuctions loads auctions into current_auctions_temp with a single
+// COPY. Rows are encoded straight from the Auction into the stream, which
+// avoids both a temp model per row and go-pg's reflection-based INSERT
+// building of insertCurrentAuctions. min_buyout is left to its default for
+// the swap to fill.
+func copyCurrentAuctions(db orm.DB, auctions []*Auction) error {
+	reader, writer := io.Pipe()
+	go func() {
+		buffered := bufio.NewWriter(writer)
+		var row []byte
+		for _, auction := range auctions {
+			row = strconv.AppendInt(row[:0], int64(auction.RealmID), 10)
+			for _, value := range [...]int64{
+				int64(auction.AuctionHouseID), int64(auction.ItemID), int64(auction.Quantity),
+				int64(auction.Min), int64(auction.Max), int64(auction.P05), int64(auction.P10),
+				int64(auction.P25), int64(auction.P50), int64(auction.P75), int64(auction.P90),
+			} {
+				row = append(row, '\t')
+				row = strconv.AppendInt(row, value, 10)
+			}
+			row = append(row, '\n')
+			if _, err := buffered.Write(row); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(buffered.Flush())
+	}()
+
+	_, err := db.CopyFrom(reader, `COPY current_auctions_temp
+		(realm_id, auction_house_id, item_id, quantity, min, max, p05, p10, p25, p50, p75, p90)
+		FROM STDIN`)
+	// Unblocks the writer if COPY stopped reading early.
+	reader.Close()
+	return err
+}
 
-	_, err = tx.Exec("ALTER TABLE current_auctions RENAME TO current_auctions_temp2")
-	if err != nil {
-		tx.Rollback()
-		return err
+func (database *Database) ReplacePriceAverages(priceAverages []*PriceAverage) error {
+	if len(priceAverages) == 0 && !database.AllowEmptyReplace {
+		return ErrEmptyReplace
 	}
 
-	_, err = tx.Exec("ALTER TABLE current_auctions_temp RENAME TO current_auctions")
+	unlock, err := database.lockReplace("price_averages")
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	defer unlock()
 
-	_, err = tx.Exec("ALTER TABLE current_auctions_temp2 RENAME TO current_auctions_temp")
+	start := time.Now()
+	err = database.loadPriceAveragesTemp(priceAverages)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	_, err = tx.Exec("TRUNCATE TABLE current_auctions_temp")
+	err = database.swapTable("price_averages", func(tx *pg.Tx) error {
+		return recordRefresh(tx, "price_averages")
+	})
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	err = tx.Commit()
+	database.reportBulkInsert("price_averages", len(priceAverages), start)
+	return nil
+}
+
+func (database *Database) loadPriceAveragesTemp(priceAverages []*PriceAverage) error {
+	_, err := database.conn().Exec("TRUNCATE TABLE price_averages_temp")
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	return nil
-}
-
-func (database *Database) ReplacePriceAverages(priceAverages []*PriceAverage) error {
 	priceAveragesTemp := make([]*priceAverageTemp, len(priceAverages))
 	for i, v := range priceAverages {
 		priceAveragesTemp[i] = &priceAverageTemp{
@@ -536,6 +3646,7 @@ func (database *Database) ReplacePriceAverages(priceAverages []*PriceAverage) er
 			P90Current:      v.P90Current,
 			P90Average:      v.P90Average,
 			P90Percent:      v.P90Percent,
+			SampleCount:     v.SampleCount,
 		}
 	}
 
@@ -545,47 +3656,61 @@ func (database *Database) ReplacePriceAverages(priceAverages []*PriceAverage) er
 			end = len(priceAverages)
 		}
 		batch := priceAveragesTemp[i:end]
-		_, err := database.db.Model(&batch).Insert()
+		_, err := database.conn().Model(&batch).Insert()
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	tx, err := database.db.Begin()
-	if err != nil {
-		tx.Rollback()
-		return err
+// ReplaceAll replaces current_auctions, price_distributions and
+// price_averages together. All three temp tables are loaded first and then
+// swapped in a single transaction, so readers never see a mix of old and new
+// tables; if any step fails all three keep their previous contents.
+func (database *Database) ReplaceAll(auctions []*Auction, priceDistributions []*PriceDistribution, priceAverages []*PriceAverage) error {
+	if (len(auctions) == 0 || len(priceDistributions) == 0 || len(priceAverages) == 0) && !database.AllowEmptyReplace {
+		return ErrEmptyReplace
 	}
 
-	_, err = tx.Exec("ALTER TABLE price_averages RENAME TO price_averages_temp2")
+	unlock, err := database.lockReplace("price_distributions", "current_auctions", "price_averages")
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	defer unlock()
 
-	_, err = tx.Exec("ALTER TABLE price_averages_temp RENAME TO price_averages")
+	start := time.Now()
+	err = database.loadPriceDistributionsTemp(priceDistributions)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-
-	_, err = tx.Exec("ALTER TABLE price_averages_temp2 RENAME TO price_averages_temp")
+	err = database.loadCurrentAuctionsTemp(auctions, database.currentAuctionsLoader())
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-
-	_, err = tx.Exec("TRUNCATE TABLE price_averages_temp")
+	err = database.loadPriceAveragesTemp(priceAverages)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	err = tx.Commit()
+	tables := []string{"price_distributions", "current_auctions", "price_averages"}
+	err = database.swapTables(tables, func(tx *pg.Tx) error {
+		err := fillMinBuyouts(tx, "")
+		if err != nil {
+			return err
+		}
+		err = recordRefresh(tx, "current_auctions")
+		if err != nil {
+			return err
+		}
+		return recordRefresh(tx, "price_averages")
+	})
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
+	database.reportCurrentAuctionsLoad(len(auctions), start)
+	database.reportBulkInsert("price_distributions", len(priceDistributions), start)
+	database.reportBulkInsert("price_averages", len(priceAverages), start)
 	return nil
 }
@@ -0,0 +1,343 @@
+package auctions_db
+
+import (
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// The database tests and benchmarks need a real Postgres with the package's
+// schema. They are skipped unless AUCTIONS_DB_TEST_DSN points at one; use a
+// scratch database, as some of them replace live tables.
+func testDSN(tb testing.TB) string {
+	dsn := os.Getenv("AUCTIONS_DB_TEST_DSN")
+	if dsn == "" {
+		tb.Skip("AUCTIONS_DB_TEST_DSN is not set")
+	}
+	return dsn
+}
+
+func testDatabase(tb testing.TB) *Database {
+	database, err := NewDatabase(testDSN(tb))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		database.Close()
+	})
+	return database
+}
+
+// TestReconnectAfterBackendTerminated kills the pool's backend, as a failover
+// would, and checks that the pool recovers without retries: at most the call
+// that hits the dead connection fails.
+func TestReconnectAfterBackendTerminated(t *testing.T) {
+	const applicationName = "auctions-db-reconnect-test"
+	database, err := NewDatabaseWithOptions(testDSN(t), DatabaseOptions{ApplicationName: applicationName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	admin := testDatabase(t)
+
+	_, err = database.db.Exec("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = admin.db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = ?", applicationName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var remaining int
+		_, err = admin.db.QueryOne(pg.Scan(&remaining), "SELECT COUNT(*) FROM pg_stat_activity WHERE application_name = ?", applicationName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d backends still running after pg_terminate_backend", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = database.db.Exec("SELECT 1")
+	t.Logf("call on the terminated connection: %v", err)
+
+	_, err = database.db.Exec("SELECT 1")
+	if err != nil {
+		t.Fatalf("call after the terminated connection failed: %v", err)
+	}
+}
+
+func BenchmarkGetCurrentAuction(b *testing.B) {
+	database := testDatabase(b)
+
+	var key struct {
+		RealmID        int16 `pg:"realm_id"`
+		AuctionHouseID int16 `pg:"auction_house_id"`
+		ItemID         int32 `pg:"item_id"`
+	}
+	_, err := database.db.QueryOne(&key, "SELECT realm_id, auction_house_id, item_id FROM current_auctions LIMIT 1")
+	if err != nil {
+		b.Skipf("no current auction to look up: %v", err)
+	}
+
+	b.Run("unprepared", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				err := database.queryCurrentAuction(&CurrentAuctionQueryResult{}, key.RealmID, key.AuctionHouseID, key.ItemID)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("prepared", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, err := database.GetCurrentAuction(key.RealmID, key.AuctionHouseID, key.ItemID)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// benchAuctions builds size current auctions over existing realm, auction
+// house and item ids, so the rows satisfy the schema's foreign keys.
+func benchAuctions(b *testing.B, database *Database, size int) []*Auction {
+	var keys []struct {
+		RealmID        int16 `pg:"realm_id"`
+		AuctionHouseID int16 `pg:"auction_house_id"`
+		ItemID         int   `pg:"item_id"`
+	}
+	_, err := database.db.Query(&keys, `
+		SELECT realms.id AS realm_id, auction_houses.id AS auction_house_id, items.id AS item_id
+		FROM realms
+		CROSS JOIN auction_houses
+		CROSS JOIN items
+		LIMIT ?
+	`, size)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(keys) < size {
+		b.Skipf("only %d realm, auction house and item combinations for %d auctions", len(keys), size)
+	}
+
+	auctions := make([]*Auction, size)
+	for i, key := range keys {
+		price := int32(i%10000 + 1)
+		auctions[i] = &Auction{
+			RealmID:        key.RealmID,
+			AuctionHouseID: key.AuctionHouseID,
+			ItemID:         key.ItemID,
+			Quantity:       int32(i%200 + 1),
+			Min:            price,
+			P05:            price + 1,
+			P10:            price + 2,
+			P25:            price + 3,
+			P50:            price + 4,
+			P75:            price + 5,
+			P90:            price + 6,
+			Max:            price + 7,
+		}
+	}
+	return auctions
+}
+
+func currentAuctionsChecksum(b *testing.B, database *Database) string {
+	var checksum string
+	_, err := database.db.QueryOne(pg.Scan(&checksum), `
+		SELECT COALESCE(md5(string_agg(current_auctions::text, ',' ORDER BY realm_id, auction_house_id, item_id)), '')
+		FROM current_auctions
+	`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return checksum
+}
+
+// BenchmarkReplaceCurrentAuctions compares the batched INSERT loader with COPY,
+// which CopyCurrentAuctions selects, and checks that both leave the same rows
+// in current_auctions.
+func BenchmarkReplaceCurrentAuctions(b *testing.B) {
+	database := testDatabase(b)
+
+	loaders := []struct {
+		name string
+		load func(db orm.DB, auctions []*Auction) error
+	}{
+		{"insert", database.insertCurrentAuctions},
+		{"copy", copyCurrentAuctions},
+	}
+
+	for _, size := range []int{10000, 100000, 1000000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			auctions := benchAuctions(b, database, size)
+
+			checksums := make(map[string]string)
+			for _, loader := range loaders {
+				b.Run(loader.name, func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						err := database.replaceCurrentAuctions(auctions, loader.load)
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.StopTimer()
+					checksums[loader.name] = currentAuctionsChecksum(b, database)
+				})
+			}
+
+			insert, inserted := checksums["insert"]
+			copied, ok := checksums["copy"]
+			if inserted && ok && insert != copied {
+				b.Errorf("current_auctions differs between loaders: insert %s, copy %s", insert, copied)
+			}
+		})
+	}
+}
+
+func TestWildcardToILike(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		like     string
+		literals int
+	}{
+		{"*Potion of*", "%Potion of%", 9},
+		{"Linen Clo?h", "Linen Clo_h", 10},
+		{"***", "%%%", 0},
+		{"100%", `100\%`, 4},
+		{"a_b", `a\_b`, 3},
+		{`a\b`, `a\\b`, 3},
+		{"", "", 0},
+	}
+	for _, test := range tests {
+		like, literals := wildcardToILike(test.pattern)
+		if like != test.like || literals != test.literals {
+			t.Errorf("wildcardToILike(%q) = %q, %d; want %q, %d", test.pattern, like, literals, test.like, test.literals)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"Copper Bar", "Copper Bar"},
+		{"100%", `100\%`},
+		{"a_b", `a\_b`},
+		{`a\b`, `a\\b`},
+		{`\%_`, `\\\%\_`},
+	}
+	for _, test := range tests {
+		if got := escapeLike(test.s); got != test.want {
+			t.Errorf("escapeLike(%q) = %q; want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestPositionalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"WHERE a = $1 AND b = $2", "WHERE a = ?0 AND b = ?1"},
+		{"$2, $1, $10", "?1, ?0, ?9"},
+	}
+	for _, test := range tests {
+		if got := positionalQuery(test.query); got != test.want {
+			t.Errorf("positionalQuery(%q) = %q; want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	tests := []struct {
+		items   []int
+		limit   int16
+		want    []int
+		hasMore bool
+	}{
+		{nil, 2, nil, false},
+		{[]int{1}, 2, []int{1}, false},
+		{[]int{1, 2}, 2, []int{1, 2}, false},
+		{[]int{1, 2, 3}, 2, []int{1, 2}, true},
+	}
+	for _, test := range tests {
+		page := newPage(test.items, 10, test.limit)
+		if !slices.Equal(page.Items, test.want) || page.HasMore != test.hasMore || page.Offset != 10 || page.Limit != test.limit {
+			t.Errorf("newPage(%v, 10, %d) = %+v; want items %v, has more %t", test.items, test.limit, *page, test.want, test.hasMore)
+		}
+	}
+}
+
+func TestCopperToGold(t *testing.T) {
+	tests := []struct {
+		copper int32
+		want   float64
+	}{
+		{0, 0},
+		{49, 0},
+		{50, 0.01},
+		{99, 0.01},
+		{12345, 1.23},
+		{1000000, 100},
+		{-150, -0.02},
+	}
+	for _, test := range tests {
+		if got := CopperToGold(test.copper); got != test.want {
+			t.Errorf("CopperToGold(%d) = %v; want %v", test.copper, got, test.want)
+		}
+	}
+}
+
+func TestIntervalValid(t *testing.T) {
+	tests := []struct {
+		interval Interval
+		want     bool
+	}{
+		{IntervalHourly, true},
+		{IntervalDaily, true},
+		{0, false},
+		{2, false},
+		{-1, false},
+	}
+	for _, test := range tests {
+		if got := test.interval.Valid(); got != test.want {
+			t.Errorf("Interval(%d).Valid() = %t; want %t", test.interval, got, test.want)
+		}
+	}
+}
+
+func TestStmtPoolSize(t *testing.T) {
+	tests := []struct {
+		poolSize int
+		want     int
+	}{
+		{0, 1},
+		{3, 1},
+		{4, 1},
+		{40, 10},
+	}
+	for _, test := range tests {
+		if got := stmtPoolSize(test.poolSize); got != test.want {
+			t.Errorf("stmtPoolSize(%d) = %d; want %d", test.poolSize, got, test.want)
+		}
+	}
+}